@@ -0,0 +1,680 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+	"github.com/julienschmidt/httprouter"
+)
+
+const apiDefaultLimit = 50
+const apiMaxLimit = 1000
+
+type apiTokenContextKey struct{}
+
+// APIToken lets scripts use the JSON API. Tokens are read from a file of
+// "name:token" lines; the name only shows up in logs.
+type APIToken struct {
+	Name  string
+	Token string
+}
+
+func readAPITokens(filePath string) ([]APIToken, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return []APIToken{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tokens := []APIToken{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || len(parts[1]) < 16 {
+			return nil, fmt.Errorf("%s: expected name:token lines with tokens of at least 16 characters", filePath)
+		}
+		tokens = append(tokens, APIToken{Name: parts[0], Token: parts[1]})
+	}
+
+	return tokens, scanner.Err()
+}
+
+func findAPIToken(presented string) *APIToken {
+	var found *APIToken
+	// check every token so the response time doesn't reveal how many were tried
+	for i := range apiTokens {
+		if subtle.ConstantTimeCompare([]byte(apiTokens[i].Token), []byte(presented)) == 1 {
+			found = &apiTokens[i]
+		}
+	}
+	return found
+}
+
+// requireAPIToken wraps an API route so it needs an "Authorization: Bearer <token>" header.
+// API routes don't use cookies, so they don't need CSRF protection.
+func requireAPIToken(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		token := findAPIToken(presented)
+		if presented == "" || token == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="creamy-stuff"`)
+			writeAPIError(w, http.StatusUnauthorized, "missing or invalid API token")
+			return
+		}
+
+		handle(w, r.WithContext(context.WithValue(r.Context(), apiTokenContextKey{}, token)), ps)
+	}
+}
+
+func apiTokenName(r *http.Request) string {
+	if token, ok := r.Context().Value(apiTokenContextKey{}).(*APIToken); ok {
+		return token.Name
+	}
+	return ""
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing API response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIJSON(w, status, &apiError{Error: message})
+}
+
+type apiChallenge struct {
+	ID         string `json:"id"`
+	SharedPath string `json:"shared_path"`
+	// SharedPaths lists every shared path, even when there is only one.
+	SharedPaths []string `json:"shared_paths"`
+	Public      bool     `json:"public"`
+	Disabled    bool     `json:"disabled"`
+	Archived    bool     `json:"archived"`
+	Note        string   `json:"note"`
+
+	HasPassword bool `json:"has_password"`
+
+	AllowedNetworks []string `json:"allowed_networks"`
+	DeniedNetworks  []string `json:"denied_networks"`
+
+	Expires    bool       `json:"expires"`
+	ValidUntil *time.Time `json:"valid_until"`
+	Expired    bool       `json:"expired"`
+
+	HasValidFrom bool       `json:"has_valid_from"`
+	ValidFrom    *time.Time `json:"valid_from"`
+	NotYetValid  bool       `json:"not_yet_valid"`
+
+	HasViewCountLimit bool `json:"has_view_count_limit"`
+	MaxViewCount      int  `json:"max_view_count"`
+	ViewCount         int  `json:"view_count"`
+	HitMaxViewCount   bool `json:"hit_max_view_count"`
+
+	ViewCounting string `json:"view_counting"`
+
+	ViewLimitPerFile bool           `json:"view_limit_per_file"`
+	FileViewCounts   map[string]int `json:"file_view_counts"`
+
+	MaxServedBytes    int64 `json:"max_served_bytes"`
+	ServedBytes       int64 `json:"served_bytes"`
+	HitByteQuota      bool  `json:"hit_byte_quota"`
+	MaxBytesPerSecond int64 `json:"max_bytes_per_second"`
+
+	AcceptsUploads    bool     `json:"accepts_uploads"`
+	MaxUploadBytes    int64    `json:"max_upload_bytes"`
+	MaxUploadFiles    int      `json:"max_upload_files"`
+	AllowedExtensions []string `json:"allowed_extensions"`
+	UploadedBytes     int64    `json:"uploaded_bytes"`
+	UploadedFiles     int      `json:"uploaded_files"`
+
+	ViewLink string `json:"view_link"`
+}
+
+func newAPIChallenge(challenge *stuff.Challenge) *apiChallenge {
+	resource := &apiChallenge{
+		ID:          challenge.ID,
+		SharedPath:  challenge.SharedPath,
+		SharedPaths: challenge.Paths(),
+		Public:      challenge.Public,
+		Disabled:    challenge.Disabled,
+		Archived:    challenge.Archived,
+		Note:        challenge.Note,
+
+		HasPassword: challenge.HasPassword,
+
+		AllowedNetworks: challenge.AllowedNetworks,
+		DeniedNetworks:  challenge.DeniedNetworks,
+
+		Expires: challenge.Expires,
+		Expired: challenge.Expired(),
+
+		HasValidFrom: challenge.HasValidFrom,
+		NotYetValid:  challenge.NotYetValid(),
+
+		HasViewCountLimit: challenge.HasViewCountLimit,
+		MaxViewCount:      challenge.MaxViewCount,
+		ViewCount:         challenge.ViewCount,
+		HitMaxViewCount:   challenge.HitMaxViewCount(),
+
+		ViewCounting: challenge.ViewCountingPolicy(),
+
+		ViewLimitPerFile: challenge.ViewLimitPerFile,
+		FileViewCounts:   challenge.FileViewCounts,
+
+		MaxServedBytes:    challenge.MaxServedBytes,
+		ServedBytes:       challenge.ServedBytes,
+		HitByteQuota:      challenge.HitByteQuota(),
+		MaxBytesPerSecond: challenge.MaxBytesPerSecond,
+
+		AcceptsUploads:    challenge.AcceptsUploads,
+		MaxUploadBytes:    challenge.MaxUploadBytes,
+		MaxUploadFiles:    challenge.MaxUploadFiles,
+		AllowedExtensions: challenge.AllowedExtensions,
+		UploadedBytes:     challenge.UploadedBytes,
+		UploadedFiles:     challenge.UploadedFiles,
+
+		ViewLink: challengeURLGenerator.ViewChallenge(challenge),
+	}
+	if challenge.Expires {
+		validUntil := challenge.ValidUntil
+		resource.ValidUntil = &validUntil
+	}
+	if challenge.HasValidFrom {
+		validFrom := challenge.ValidFrom
+		resource.ValidFrom = &validFrom
+	}
+	return resource
+}
+
+type apiChallengeView struct {
+	Time        time.Time `json:"time"`
+	IP          string    `json:"ip"`
+	NetworkRule string    `json:"network_rule"`
+
+	Upload       bool   `json:"upload"`
+	FailedUnlock bool   `json:"failed_unlock"`
+	FilePath     string `json:"file_path"`
+	UserAgent    string `json:"user_agent"`
+	Bytes        int64  `json:"bytes"`
+	Status       int    `json:"status"`
+	Counted      bool   `json:"counted"`
+	Complete     bool   `json:"complete"`
+}
+
+func newAPIChallengeViews(views []*stuff.ChallengeView) []*apiChallengeView {
+	resources := make([]*apiChallengeView, len(views))
+	for i, view := range views {
+		resources[i] = &apiChallengeView{
+			Time:        view.Time,
+			IP:          view.IP,
+			NetworkRule: view.NetworkRule,
+
+			Upload:       view.Upload,
+			FailedUnlock: view.FailedUnlock,
+			FilePath:     view.FilePath,
+			UserAgent:    view.UserAgent,
+			Bytes:        view.Bytes,
+			Status:       view.Status,
+			Counted:      !view.Uncounted,
+			Complete:     view.Complete,
+		}
+	}
+	return resources
+}
+
+// apiChallengeRequest is the body of create and update requests.
+// Fields left out are not changed.
+type apiChallengeRequest struct {
+	// ID and IDStyle can only be chosen when creating. Setting ID implies the custom style.
+	ID         *string `json:"id"`
+	IDStyle    *string `json:"id_style"`
+	SharedPath *string `json:"shared_path"`
+	// SharedPaths shares several paths at once, instead of SharedPath.
+	SharedPaths []string `json:"shared_paths"`
+	Public      *bool    `json:"public"`
+	Disabled    *bool    `json:"disabled"`
+	Note        *string  `json:"note"`
+
+	// Password sets a new password, or removes it when empty.
+	Password *string `json:"password"`
+
+	// Networks are CIDRs or addresses, an empty list removes the rule.
+	AllowedNetworks *[]string `json:"allowed_networks"`
+	DeniedNetworks  *[]string `json:"denied_networks"`
+
+	// ValidUntil also turns on expiry unless Expires is false.
+	Expires    *bool      `json:"expires"`
+	ValidUntil *time.Time `json:"valid_until"`
+
+	// ValidFrom keeps the link closed until then, unless HasValidFrom is false.
+	HasValidFrom *bool      `json:"has_valid_from"`
+	ValidFrom    *time.Time `json:"valid_from"`
+
+	// MaxViewCount also turns on the view limit unless HasViewCountLimit is false.
+	HasViewCountLimit *bool `json:"has_view_count_limit"`
+	MaxViewCount      *int  `json:"max_view_count"`
+
+	// ViewCounting is one of stuff.ViewCountings.
+	ViewCounting *string `json:"view_counting"`
+	// ViewLimitPerFile applies MaxViewCount to each file on its own.
+	ViewLimitPerFile *bool `json:"view_limit_per_file"`
+
+	// Download limits of 0 mean no limit.
+	MaxServedBytes    *int64 `json:"max_served_bytes"`
+	MaxBytesPerSecond *int64 `json:"max_bytes_per_second"`
+
+	// Upload limits of 0 and an empty extension list mean no limit.
+	AcceptsUploads    *bool     `json:"accepts_uploads"`
+	MaxUploadBytes    *int64    `json:"max_upload_bytes"`
+	MaxUploadFiles    *int      `json:"max_upload_files"`
+	AllowedExtensions *[]string `json:"allowed_extensions"`
+}
+
+func decodeAPIChallengeRequest(w http.ResponseWriter, r *http.Request) (*apiChallengeRequest, error) {
+	var req apiChallengeRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid request body: %v", err)
+	}
+
+	if req.Expires != nil && *req.Expires && req.ValidUntil == nil {
+		return nil, errors.New("valid_until is required when expires is true")
+	}
+	if req.HasValidFrom != nil && *req.HasValidFrom && req.ValidFrom == nil {
+		return nil, errors.New("valid_from is required when has_valid_from is true")
+	}
+	for _, networks := range []*[]string{req.AllowedNetworks, req.DeniedNetworks} {
+		if networks == nil {
+			continue
+		}
+		parsed, err := stuff.ParseNetworks(strings.Join(*networks, ","))
+		if err != nil {
+			return nil, err
+		}
+		*networks = parsed
+	}
+	if req.MaxViewCount != nil && *req.MaxViewCount < 1 {
+		return nil, errors.New("max_view_count must be at least 1")
+	}
+	if req.HasViewCountLimit != nil && *req.HasViewCountLimit && req.MaxViewCount == nil {
+		return nil, errors.New("max_view_count is required when has_view_count_limit is true")
+	}
+	if req.ViewCounting != nil && !stuff.IsViewCounting(*req.ViewCounting) {
+		return nil, errViewCounting
+	}
+	if (req.MaxServedBytes != nil && *req.MaxServedBytes < 0) || (req.MaxBytesPerSecond != nil && *req.MaxBytesPerSecond < 0) {
+		return nil, errors.New("download limits must not be negative")
+	}
+	if (req.MaxUploadBytes != nil && *req.MaxUploadBytes < 0) || (req.MaxUploadFiles != nil && *req.MaxUploadFiles < 0) {
+		return nil, errors.New("upload limits must not be negative")
+	}
+
+	return &req, nil
+}
+
+// passwordHash hashes the requested password up front, so bcrypt doesn't run
+// while the repository is locked.
+func (req *apiChallengeRequest) passwordHash() (string, error) {
+	if req.Password == nil || *req.Password == "" {
+		return "", nil
+	}
+	return stuff.HashPassword(*req.Password)
+}
+
+func (req *apiChallengeRequest) apply(challenge *stuff.Challenge, passwordHash string) {
+	if req.Public != nil {
+		challenge.Public = *req.Public
+	}
+	if req.Disabled != nil {
+		challenge.Disabled = *req.Disabled
+	}
+	if req.Note != nil {
+		challenge.Note = *req.Note
+	}
+
+	if req.Password != nil {
+		if passwordHash == "" {
+			challenge.RemovePassword()
+		} else {
+			challenge.SetPasswordHash(passwordHash)
+		}
+	}
+
+	if req.AllowedNetworks != nil {
+		challenge.AllowedNetworks = *req.AllowedNetworks
+	}
+	if req.DeniedNetworks != nil {
+		challenge.DeniedNetworks = *req.DeniedNetworks
+	}
+
+	if req.ValidUntil != nil {
+		challenge.SetExpirationDate(*req.ValidUntil)
+	}
+	if req.Expires != nil && !*req.Expires {
+		challenge.RemoveExpirationDate()
+	}
+
+	if req.ValidFrom != nil {
+		challenge.SetValidFrom(*req.ValidFrom)
+	}
+	if req.HasValidFrom != nil && !*req.HasValidFrom {
+		challenge.RemoveValidFrom()
+	}
+
+	if req.MaxViewCount != nil {
+		challenge.SetMaxViewCount(*req.MaxViewCount)
+	}
+	if req.HasViewCountLimit != nil && !*req.HasViewCountLimit {
+		challenge.RemoveMaxViewCount()
+	}
+	if req.ViewCounting != nil {
+		challenge.ViewCounting = *req.ViewCounting
+	}
+	if req.ViewLimitPerFile != nil {
+		challenge.ViewLimitPerFile = *req.ViewLimitPerFile
+	}
+
+	if req.MaxServedBytes != nil {
+		challenge.MaxServedBytes = *req.MaxServedBytes
+	}
+	if req.MaxBytesPerSecond != nil {
+		challenge.MaxBytesPerSecond = *req.MaxBytesPerSecond
+	}
+
+	if req.AcceptsUploads != nil {
+		challenge.AcceptsUploads = *req.AcceptsUploads
+	}
+	if req.MaxUploadBytes != nil {
+		challenge.MaxUploadBytes = *req.MaxUploadBytes
+	}
+	if req.MaxUploadFiles != nil {
+		challenge.MaxUploadFiles = *req.MaxUploadFiles
+	}
+	if req.AllowedExtensions != nil {
+		challenge.AllowedExtensions = parseExtensions(*req.AllowedExtensions)
+	}
+
+	if _, dead := challenge.DeadSince(); !dead {
+		challenge.Archived = false
+	}
+}
+
+func apiPagination(r *http.Request) (int, int, error) {
+	limit := apiDefaultLimit
+	offset := 0
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > apiMaxLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", apiMaxLimit)
+		}
+		limit = parsed
+	}
+
+	if value := r.URL.Query().Get("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return 0, 0, errors.New("offset must not be negative")
+		}
+		offset = parsed
+	}
+
+	return limit, offset, nil
+}
+
+func isChallengeStatus(status string) bool {
+	for _, known := range stuff.ChallengeStatuses {
+		if status == known {
+			return true
+		}
+	}
+	return false
+}
+
+func handleAPIChallengesIndex(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	limit, offset, err := apiPagination(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	if status := query.Get("status"); status != "" && !isChallengeStatus(status) {
+		writeAPIError(w, http.StatusBadRequest, "status must be one of "+strings.Join(stuff.ChallengeStatuses, ", "))
+		return
+	}
+
+	challenges, total := challengeRepository.Query(stuff.ChallengeQuery{
+		Status:     query.Get("status"),
+		PathPrefix: query.Get("path_prefix"),
+		Search:     query.Get("q"),
+
+		Limit:  limit,
+		Offset: offset,
+	})
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	resources := make([]*apiChallenge, len(challenges))
+	for i, challenge := range challenges {
+		resources[i] = newAPIChallenge(challenge)
+	}
+
+	writeAPIJSON(w, http.StatusOK, resources)
+}
+
+func handleAPIChallengeShow(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	challenge := challengeRepository.Get(ps.ByName("challenge"))
+	if challenge == nil {
+		writeAPIError(w, http.StatusNotFound, "challenge not found")
+		return
+	}
+
+	writeAPIJSON(w, http.StatusOK, newAPIChallenge(challenge))
+}
+
+func handleAPIChallengeViews(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	challenge := challengeRepository.Get(ps.ByName("challenge"))
+	if challenge == nil {
+		writeAPIError(w, http.StatusNotFound, "challenge not found")
+		return
+	}
+
+	writeAPIJSON(w, http.StatusOK, newAPIChallengeViews(challenge.Views()))
+}
+
+func handleAPIChallengeCreate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	req, err := decodeAPIChallengeRequest(w, r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var filePaths []string
+	if req.SharedPath != nil && *req.SharedPath != "" {
+		if len(req.SharedPaths) > 0 {
+			writeAPIError(w, http.StatusBadRequest, "shared_path and shared_paths can't both be set")
+			return
+		}
+		filePaths = []string{path.Clean("/" + *req.SharedPath)}
+	} else {
+		filePaths = parseSharedPaths(req.SharedPaths)
+	}
+	if len(filePaths) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "shared_path is required")
+		return
+	}
+
+	for _, filePath := range filePaths {
+		file, err := dataFileSystem.Open(filePath)
+		if err != nil {
+			writeAPIError(w, http.StatusUnprocessableEntity, fmt.Sprintf("shared path %v does not exist", filePath))
+			return
+		}
+		stat, err := file.Stat()
+		file.Close()
+		if err != nil {
+			log.Printf("Error stat'ing file %v: %v", filePath, err)
+			writeAPIError(w, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		if req.AcceptsUploads != nil && *req.AcceptsUploads && (!stat.IsDir() || len(filePaths) > 1) {
+			writeAPIError(w, http.StatusUnprocessableEntity, errUploadsNeedDirectory.Error())
+			return
+		}
+	}
+
+	passwordHash, err := req.passwordHash()
+	if err != nil {
+		log.Printf("Error hashing challenge password: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	var idStyle, slug string
+	if req.IDStyle != nil {
+		idStyle = *req.IDStyle
+	}
+	if req.ID != nil {
+		slug = *req.ID
+		if idStyle == "" {
+			idStyle = challengeIDStyleCustom
+		}
+	}
+
+	challenge := &stuff.Challenge{
+		SharedPath: filePaths[0],
+	}
+	if len(filePaths) > 1 {
+		challenge.SharedPath = ""
+		challenge.SharedPaths = filePaths
+	}
+	req.apply(challenge, passwordHash)
+
+	err = createChallenge(challengeRepository, config, challenge, idStyle, slug)
+	switch err {
+	case nil:
+	case errChallengeIDStyle, errChallengeSlug:
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	case stuff.ErrChallengeIDTaken:
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	default:
+		log.Printf("Error creating challenge: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	log.Printf("API token %s shared %v as %v", apiTokenName(r), challenge.DisplayPath(), challenge.ID)
+
+	w.Header().Set("Location", adminURLGenerator.APIChallengePath(challenge))
+	writeAPIJSON(w, http.StatusCreated, newAPIChallenge(challenge))
+}
+
+var errUploadsNeedDirectory = errors.New("shared_path must be a single directory to accept uploads")
+
+// isDirectory checks a path relative to the data directory.
+func isDirectory(filePath string) bool {
+	resolvedPath, err := dataFileSystem.Resolve(filePath)
+	if err != nil {
+		return false
+	}
+	stat, err := os.Stat(resolvedPath)
+	return err == nil && stat.IsDir()
+}
+
+func handleAPIChallengeUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	req, err := decodeAPIChallengeRequest(w, r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.SharedPath != nil || req.SharedPaths != nil {
+		writeAPIError(w, http.StatusBadRequest, "shared_path can't be changed")
+		return
+	}
+	if req.ID != nil || req.IDStyle != nil {
+		writeAPIError(w, http.StatusBadRequest, "id can't be changed")
+		return
+	}
+
+	passwordHash, err := req.passwordHash()
+	if err != nil {
+		log.Printf("Error hashing challenge password: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// shared paths can't change, so check the disk before Update takes the lock
+	challenge := challengeRepository.Get(ps.ByName("challenge"))
+	if challenge == nil {
+		writeAPIError(w, http.StatusNotFound, "challenge not found")
+		return
+	}
+	sharesDirectory := len(challenge.SharedPaths) == 0 && isDirectory(challenge.SharedPath)
+
+	challenge, err = challengeRepository.Update(ps.ByName("challenge"), func(challenge *stuff.Challenge) error {
+		req.apply(challenge, passwordHash)
+		if challenge.AcceptsUploads && !sharesDirectory {
+			return errUploadsNeedDirectory
+		}
+		return nil
+	})
+	if err == stuff.ErrChallengeNotFound {
+		writeAPIError(w, http.StatusNotFound, "challenge not found")
+		return
+	}
+	if err == errUploadsNeedDirectory {
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating challenge %v: %v", ps.ByName("challenge"), err)
+		writeAPIError(w, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	writeAPIJSON(w, http.StatusOK, newAPIChallenge(challenge))
+}
+
+func handleAPIChallengeDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	challenge := challengeRepository.Get(ps.ByName("challenge"))
+	if challenge == nil {
+		writeAPIError(w, http.StatusNotFound, "challenge not found")
+		return
+	}
+
+	challengeRepository.Bury(challenge)
+	log.Printf("API token %s revoked %v", apiTokenName(r), challenge.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
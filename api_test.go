@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+	"github.com/julienschmidt/httprouter"
+)
+
+const testAPIToken = "abcdefghijklmnop1234"
+
+// newTestAPI serves the API over a data directory holding a "docs" directory and a "notes.txt" file.
+func newTestAPI(t *testing.T) (*httprouter.Router, stuff.ChallengeRepository) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "notes.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := stuff.NewArrayChallengeRepository()
+	challengeRepository = repo
+	dataFileSystem = (&Config{DataDirectory: root}).FileSystem()
+	apiTokens = []APIToken{{Name: "test", Token: testAPIToken}}
+	t.Cleanup(func() {
+		challengeRepository = nil
+		dataFileSystem = nil
+		apiTokens = nil
+	})
+
+	router := httprouter.New()
+	router.GET("/api/v1/challenges", requireAPIToken(handleAPIChallengesIndex))
+	router.POST("/api/v1/challenges", requireAPIToken(handleAPIChallengeCreate))
+	router.GET("/api/v1/challenges/:challenge", requireAPIToken(handleAPIChallengeShow))
+	router.PATCH("/api/v1/challenges/:challenge", requireAPIToken(handleAPIChallengeUpdate))
+	router.DELETE("/api/v1/challenges/:challenge", requireAPIToken(handleAPIChallengeDelete))
+	return router, repo
+}
+
+func apiRequest(router http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testAPIToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIRequiresToken(t *testing.T) {
+	router, _ := newTestAPI(t)
+
+	for _, authorization := range []string{"", "Bearer ", "Bearer wrongwrongwrongwrong", testAPIToken + "x"} {
+		r := httptest.NewRequest("GET", "/api/v1/challenges", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		var body apiError
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%q: expected 401 with WWW-Authenticate but got %d", authorization, w.Code)
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error == "" {
+			t.Errorf("%q: expected a JSON error but got %v", authorization, err)
+		}
+	}
+
+	if w := apiRequest(router, "GET", "/api/v1/challenges", ""); w.Code != http.StatusOK {
+		t.Errorf("expected a valid token to be let in but got %d", w.Code)
+	}
+}
+
+func TestAPIChallengeLifecycle(t *testing.T) {
+	router, repo := newTestAPI(t)
+
+	w := apiRequest(router, "POST", "/api/v1/challenges", `{"id": "team-docs", "shared_path": "docs", "public": true, "accepts_uploads": true}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/api/v1/challenges/team-docs" {
+		t.Fatalf("expected 201 at /api/v1/challenges/team-docs but got %d at %q: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	var created apiChallenge
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ID != "team-docs" || created.SharedPath != "/docs" || !created.Public || !created.AcceptsUploads {
+		t.Errorf("unexpected challenge created: %+v", created)
+	}
+
+	w = apiRequest(router, "PATCH", "/api/v1/challenges/team-docs", `{"public": false, "note": "for the team", "max_view_count": 3}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 but got %d: %s", w.Code, w.Body)
+	}
+	challenge := repo.Get("team-docs")
+	if challenge.Public || challenge.Note != "for the team" || !challenge.HasViewCountLimit || challenge.MaxViewCount != 3 || !challenge.AcceptsUploads {
+		t.Errorf("unexpected challenge after update: %+v", challenge)
+	}
+
+	if w = apiRequest(router, "POST", "/api/v1/challenges", `{"id": "team-docs", "shared_path": "notes.txt"}`); w.Code != http.StatusConflict {
+		t.Errorf("expected taken IDs to conflict but got %d", w.Code)
+	}
+
+	if w = apiRequest(router, "DELETE", "/api/v1/challenges/team-docs", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 but got %d", w.Code)
+	}
+	if repo.Get("team-docs") != nil || repo.Tombstone("team-docs") == nil {
+		t.Errorf("expected team-docs to be replaced by a tombstone")
+	}
+	if w = apiRequest(router, "DELETE", "/api/v1/challenges/team-docs", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected deleting twice to 404 but got %d", w.Code)
+	}
+	if w = apiRequest(router, "POST", "/api/v1/challenges", `{"id": "team-docs", "shared_path": "docs"}`); w.Code != http.StatusConflict {
+		t.Errorf("expected a revoked ID not to be handed out again but got %d", w.Code)
+	}
+}
+
+func TestAPIRejectsBadInput(t *testing.T) {
+	router, repo := newTestAPI(t)
+	repo.Set(&stuff.Challenge{ID: "notes", SharedPath: "/notes.txt"})
+
+	cases := []struct {
+		method   string
+		target   string
+		body     string
+		expected int
+	}{
+		{"POST", "/api/v1/challenges", `{"shared_path": `, http.StatusBadRequest},
+		{"POST", "/api/v1/challenges", `{"shared_path": "docs", "colour": "blue"}`, http.StatusBadRequest},
+		{"POST", "/api/v1/challenges", `{"public": true}`, http.StatusBadRequest},
+		{"POST", "/api/v1/challenges", `{"shared_path": "docs", "shared_paths": ["notes.txt"]}`, http.StatusBadRequest},
+		{"POST", "/api/v1/challenges", `{"shared_path": "docs", "max_view_count": 0}`, http.StatusBadRequest},
+		{"POST", "/api/v1/challenges", `{"shared_path": "docs", "expires": true}`, http.StatusBadRequest},
+		{"POST", "/api/v1/challenges", `{"shared_path": "docs", "allowed_networks": ["not a network"]}`, http.StatusBadRequest},
+		{"POST", "/api/v1/challenges", `{"shared_path": "docs", "max_served_bytes": -1}`, http.StatusBadRequest},
+		{"POST", "/api/v1/challenges", `{"shared_path": "docs", "id": "no spaces please"}`, http.StatusBadRequest},
+		{"POST", "/api/v1/challenges", `{"shared_path": "missing"}`, http.StatusUnprocessableEntity},
+		{"POST", "/api/v1/challenges", `{"shared_path": "notes.txt", "accepts_uploads": true}`, http.StatusUnprocessableEntity},
+		{"PATCH", "/api/v1/challenges/notes", `{"shared_path": "docs"}`, http.StatusBadRequest},
+		{"PATCH", "/api/v1/challenges/notes", `{"id": "renamed"}`, http.StatusBadRequest},
+		{"PATCH", "/api/v1/challenges/notes", `{"accepts_uploads": true}`, http.StatusUnprocessableEntity},
+		{"PATCH", "/api/v1/challenges/missing", `{"public": true}`, http.StatusNotFound},
+		{"GET", "/api/v1/challenges?limit=0", "", http.StatusBadRequest},
+		{"GET", "/api/v1/challenges?offset=-1", "", http.StatusBadRequest},
+		{"GET", "/api/v1/challenges?status=bogus", "", http.StatusBadRequest},
+		{"GET", "/api/v1/challenges/missing", "", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		w := apiRequest(router, c.method, c.target, c.body)
+		if w.Code != c.expected {
+			t.Errorf("%s %s %s: expected %d but got %d: %s", c.method, c.target, c.body, c.expected, w.Code, w.Body)
+			continue
+		}
+
+		var body apiError
+		if w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s %s: expected JSON but got %q", c.method, c.target, c.body, w.Header().Get("Content-Type"))
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error == "" {
+			t.Errorf("%s %s %s: expected an error message but got %v", c.method, c.target, c.body, err)
+		}
+	}
+
+	if challenge := repo.Get("notes"); challenge.AcceptsUploads {
+		t.Errorf("expected the refused update to leave notes unchanged")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/AlbinoDrought/creamy-stuff/safefs"
+)
+
+const archiveFormatZip = "zip"
+const archiveFormatTarGz = "tar.gz"
+
+var archiveContentTypes = map[string]string{
+	archiveFormatZip:   "application/zip",
+	archiveFormatTarGz: "application/gzip",
+}
+
+// walkArchiveFiles calls fn for every visible regular file under the directory
+// name in fsys, with its path inside the archive. Special files are skipped.
+func walkArchiveFiles(fsys *safefs.FileSystem, name string, prefix string, fn func(archivePath string, filePath string, info os.FileInfo) error) error {
+	root := path.Clean("/" + name)
+	return fsys.Walk(root, func(name string, filePath string, info os.FileInfo) error {
+		relativePath := strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+		return fn(path.Join(prefix, relativePath), filePath, info)
+	})
+}
+
+func copyFileTo(w io.Writer, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// archiveSource is a file or directory name in fsys, placed under prefix in an archive.
+type archiveSource struct {
+	fsys   *safefs.FileSystem
+	name   string
+	prefix string
+}
+
+func walkArchiveSources(sources []archiveSource, fn func(archivePath string, filePath string, info os.FileInfo) error) error {
+	for _, source := range sources {
+		if err := walkArchiveFiles(source.fsys, source.name, source.prefix, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeZipArchive(w io.Writer, sources []archiveSource) error {
+	archive := zip.NewWriter(w)
+
+	err := walkArchiveSources(sources, func(archivePath string, filePath string, info os.FileInfo) error {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = archivePath
+		header.Method = zip.Deflate
+
+		entry, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		return copyFileTo(entry, filePath)
+	})
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func writeTarGzArchive(w io.Writer, sources []archiveSource) error {
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+
+	err := walkArchiveSources(sources, func(archivePath string, filePath string, info os.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = archivePath
+
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		return copyFileTo(archive, filePath)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+// writeArchive streams sources as one archive, without temporary files.
+func writeArchive(w io.Writer, format string, sources []archiveSource) error {
+	switch format {
+	case archiveFormatZip:
+		return writeZipArchive(w, sources)
+	case archiveFormatTarGz:
+		return writeTarGzArchive(w, sources)
+	}
+	return fmt.Errorf("unknown archive format %q", format)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+	"github.com/AlbinoDrought/creamy-stuff/templates"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	adminAuthUsers = "users"
+	adminAuthProxy = "proxy"
+	adminAuthNone  = "none"
+)
+
+const adminSessionCookieName = "ADMIN-SESSION"
+const adminSessionPurpose = "admin-session"
+const adminDefaultUsername = "admin"
+const adminRandomPasswordLength = 18
+
+type adminUserContextKey struct{}
+
+// AdminAuthenticator decides who, if anyone, is allowed into the private routes.
+type AdminAuthenticator interface {
+	// AdminUser returns the authenticated admin's name, or "" if there is none.
+	AdminUser(r *http.Request) string
+	// Challenge responds to a request that has no authenticated admin.
+	Challenge(w http.ResponseWriter, r *http.Request)
+}
+
+// userFileAuthenticator checks logins against a file of "username:bcrypt-hash"
+// lines, compatible with `htpasswd -B`, and remembers them in signed cookies.
+type userFileAuthenticator struct {
+	users    map[string]string
+	signer   *stuff.TokenSigner
+	lifetime time.Duration
+
+	// dummyHash is compared against for unknown users so they take as long as wrong passwords
+	dummyHash []byte
+}
+
+func (auth *userFileAuthenticator) subject(username string) string {
+	// binding to the hash means changing a password logs out that user's sessions
+	return username + "\x00" + auth.users[username]
+}
+
+func (auth *userFileAuthenticator) AdminUser(r *http.Request) string {
+	cookie, _ := r.Cookie(adminSessionCookieName)
+	if cookie == nil {
+		return ""
+	}
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	username, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ""
+	}
+	if _, exists := auth.users[string(username)]; !exists {
+		return ""
+	}
+	if !auth.signer.Verify(parts[1], adminSessionPurpose, auth.subject(string(username))) {
+		return ""
+	}
+
+	return string(username)
+}
+
+func (auth *userFileAuthenticator) Challenge(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, adminURLGenerator.LoginPath(r.URL.RequestURI()), http.StatusFound)
+}
+
+func (auth *userFileAuthenticator) Login(username string, password string, w http.ResponseWriter) bool {
+	hash, exists := auth.users[username]
+	if !exists {
+		bcrypt.CompareHashAndPassword(auth.dummyHash, []byte(password))
+		return false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+
+	expires := time.Now().Add(auth.lifetime)
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminSessionCookieName,
+		Path:     "/",
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(username)) + "." + auth.signer.Sign(adminSessionPurpose, auth.subject(username), expires),
+		MaxAge:   int(auth.lifetime.Seconds()),
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return true
+}
+
+func (auth *userFileAuthenticator) Logout(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminSessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// proxyHeaderAuthenticator trusts a reverse proxy to authenticate admins
+// and pass their name along in a header. Anyone else could send the header too,
+// so it is only believed from proxies.
+type proxyHeaderAuthenticator struct {
+	header  string
+	proxies []*net.IPNet
+}
+
+func (auth *proxyHeaderAuthenticator) AdminUser(r *http.Request) string {
+	user := r.Header.Get(auth.header)
+	if user != "" && !networksContain(auth.proxies, peerIP(r)) {
+		log.Printf("Ignoring %s header from %v, which isn't a trusted proxy", auth.header, peerIP(r))
+		return ""
+	}
+	return user
+}
+
+func (auth *proxyHeaderAuthenticator) Challenge(w http.ResponseWriter, r *http.Request) {
+	renderUnauthorized(w, r)
+}
+
+// noAuthenticator lets everyone in. It must be chosen explicitly.
+type noAuthenticator struct{}
+
+func (auth *noAuthenticator) AdminUser(r *http.Request) string {
+	return "anonymous"
+}
+
+func (auth *noAuthenticator) Challenge(w http.ResponseWriter, r *http.Request) {
+	renderUnauthorized(w, r)
+}
+
+func readAdminUsers(filePath string) (map[string]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "$2") {
+			return nil, fmt.Errorf("%s: expected username:bcrypt-hash lines", filePath)
+		}
+		users[parts[0]] = parts[1]
+	}
+
+	return users, scanner.Err()
+}
+
+// createAdminUsers writes a users file with a single admin and a random password,
+// logging the password once so a fresh install is never left open.
+func createAdminUsers(filePath string) error {
+	password, err := RandomString(adminRandomPasswordLength)
+	if err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filePath, []byte(adminDefaultUsername+":"+string(hash)+"\n"), 0600); err != nil {
+		return err
+	}
+
+	log.Printf("Created %s with user %q and password %q", filePath, adminDefaultUsername, password)
+	return nil
+}
+
+func newAdminAuthenticator(config *Config, signer *stuff.TokenSigner) (AdminAuthenticator, error) {
+	switch config.AdminAuth {
+	case adminAuthUsers:
+		if _, err := os.Stat(config.AdminUsersFile); os.IsNotExist(err) {
+			if err := createAdminUsers(config.AdminUsersFile); err != nil {
+				return nil, err
+			}
+		}
+
+		users, err := readAdminUsers(config.AdminUsersFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(users) == 0 {
+			return nil, fmt.Errorf("%s has no users", config.AdminUsersFile)
+		}
+
+		dummyHash, err := bcrypt.GenerateFromPassword([]byte(adminDefaultUsername), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+
+		return &userFileAuthenticator{
+			users:     users,
+			signer:    signer,
+			lifetime:  config.AdminSessionLifetime,
+			dummyHash: dummyHash,
+		}, nil
+	case adminAuthProxy:
+		proxies, err := config.TrustedProxyNetworks()
+		if err != nil {
+			return nil, err
+		}
+		return &proxyHeaderAuthenticator{
+			header:  config.AdminProxyHeader,
+			proxies: proxies,
+		}, nil
+	case adminAuthNone:
+		log.Printf("Warning: admin authentication is disabled, anyone who can reach %s can browse and share everything", config.ListenAddress)
+		return &noAuthenticator{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown admin auth mode %q", config.AdminAuth)
+}
+
+// requireAdmin wraps a private route so it is only reachable by an authenticated admin.
+func requireAdmin(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user := adminAuthenticator.AdminUser(r)
+		if user == "" {
+			adminAuthenticator.Challenge(w, r)
+			return
+		}
+
+		handle(w, r.WithContext(context.WithValue(r.Context(), adminUserContextKey{}, user)), ps)
+	}
+}
+
+func adminUser(r *http.Request) string {
+	user, _ := r.Context().Value(adminUserContextKey{}).(string)
+	return user
+}
+
+func privateNav(r *http.Request) *templates.PrivateNav {
+	_, canLogout := adminAuthenticator.(*userFileAuthenticator)
+	return &templates.PrivateNav{
+		User:      adminUser(r),
+		CanLogout: canLogout,
+
+		HomeLink:       adminURLGenerator.HomePath(),
+		BrowseLink:     browseURLGenerator.BrowsePath("/"),
+		ChallengesLink: adminURLGenerator.ChallengesPath(),
+		LogoutLink:     adminURLGenerator.LogoutPath(),
+	}
+}
+
+// safeRedirectTarget only allows local paths, so the login form can't be used as an open redirect.
+func safeRedirectTarget(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return adminURLGenerator.HomePath()
+	}
+	return target
+}
+
+func handleLoginForm(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if _, ok := adminAuthenticator.(*userFileAuthenticator); !ok {
+		http.Redirect(w, r, adminURLGenerator.HomePath(), http.StatusFound)
+		return
+	}
+
+	csrfToken, err := getOrCreateCSRF(w, r)
+	if err != nil {
+		log.Printf("Error with getOrCreateCSRF: %v", err)
+		renderServerError(w, r, err)
+		return
+	}
+
+	templates.WritePageTemplate(w, &templates.LoginPage{
+		CSRF:   csrfToken,
+		Next:   safeRedirectTarget(r.FormValue("next")),
+		Action: adminURLGenerator.LoginPath(""),
+	}, &templates.EmptyNav{})
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	auth, ok := adminAuthenticator.(*userFileAuthenticator)
+	if !ok {
+		http.Redirect(w, r, adminURLGenerator.HomePath(), http.StatusFound)
+		return
+	}
+
+	if err := validCSRF(r, r.FormValue("_token")); err != nil {
+		log.Printf("Error validating CSRF token: %v", err)
+		renderServerError(w, r, err)
+		return
+	}
+
+	next := safeRedirectTarget(r.FormValue("next"))
+	username := r.FormValue("username")
+	if auth.Login(username, r.FormValue("password"), w) {
+		http.Redirect(w, r, next, http.StatusFound)
+		return
+	}
+
+	log.Printf("Failed admin login for %q from %v", username, r.RemoteAddr)
+
+	csrfToken, err := getOrCreateCSRF(w, r)
+	if err != nil {
+		log.Printf("Error with getOrCreateCSRF: %v", err)
+		renderServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+	templates.WritePageTemplate(w, &templates.LoginPage{
+		CSRF:     csrfToken,
+		Next:     next,
+		Action:   adminURLGenerator.LoginPath(""),
+		Username: username,
+		Error:    "Incorrect username or password",
+	}, &templates.EmptyNav{})
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if auth, ok := adminAuthenticator.(*userFileAuthenticator); ok {
+		auth.Logout(w)
+		http.Redirect(w, r, adminURLGenerator.LoginPath(""), http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, adminURLGenerator.HomePath(), http.StatusFound)
+}
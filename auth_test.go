@@ -0,0 +1,210 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestUserFileAuthenticator(t *testing.T) *userFileAuthenticator {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &userFileAuthenticator{
+		users:     map[string]string{"alice": string(hash), "bob": string(hash)},
+		signer:    &stuff.TokenSigner{Key: []byte("0123456789abcdef0123456789abcdef")},
+		lifetime:  time.Hour,
+		dummyHash: []byte(hash),
+	}
+}
+
+func loginRequest(username string, password string, next string) *http.Request {
+	form := url.Values{
+		"_token":   {"csrf"},
+		"username": {username},
+		"password": {password},
+		"next":     {next},
+	}
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "csrf"})
+	return r
+}
+
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == adminSessionCookieName {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	auth := newTestUserFileAuthenticator(t)
+	adminAuthenticator = auth
+	defer func() { adminAuthenticator = nil }()
+
+	w := httptest.NewRecorder()
+	handleLogin(w, loginRequest("alice", "hunter2", "/challenges"), nil)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/challenges" {
+		t.Fatalf("expected a redirect to /challenges but got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	cookie := sessionCookie(w)
+	if cookie == nil || !cookie.HttpOnly {
+		t.Fatalf("expected an HttpOnly session cookie but got %+v", cookie)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	if user := auth.AdminUser(r); user != "alice" {
+		t.Errorf("expected the session cookie to log in alice but got %q", user)
+	}
+
+	for _, username := range []string{"alice", "carol"} {
+		w = httptest.NewRecorder()
+		handleLogin(w, loginRequest(username, "wrong", "/challenges"), nil)
+		if w.Code != http.StatusUnauthorized || sessionCookie(w) != nil {
+			t.Errorf("%v: expected 401 and no session but got %d", username, w.Code)
+		}
+	}
+
+	r = loginRequest("alice", "hunter2", "/challenges")
+	r.Header.Del("Cookie")
+	w = httptest.NewRecorder()
+	handleLogin(w, r, nil)
+	if w.Code == http.StatusFound || sessionCookie(w) != nil {
+		t.Errorf("expected logins without a CSRF cookie to be refused but got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleLogin(w, loginRequest("alice", "hunter2", "//evil.example"), nil)
+	if w.Header().Get("Location") != "/" {
+		t.Errorf("expected an unsafe next to redirect home but got %q", w.Header().Get("Location"))
+	}
+}
+
+func TestSessionCookieVerification(t *testing.T) {
+	auth := newTestUserFileAuthenticator(t)
+	w := httptest.NewRecorder()
+	if !auth.Login("alice", "hunter2", w) {
+		t.Fatal("expected alice to log in")
+	}
+	valid := sessionCookie(w).Value
+	_, signature, _ := strings.Cut(valid, ".")
+
+	otherSigner := newTestUserFileAuthenticator(t)
+	otherSigner.signer = &stuff.TokenSigner{Key: []byte("another key entirely")}
+	otherSigner.users = auth.users
+	w = httptest.NewRecorder()
+	otherSigner.Login("alice", "hunter2", w)
+
+	cases := map[string]string{
+		"missing separator": "alice",
+		"other user":        "Ym9i." + signature,
+		"bad base64":        "!!!." + signature,
+		"bad signature":     valid + "x",
+		"other key":         sessionCookie(w).Value,
+	}
+	for name, value := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: adminSessionCookieName, Value: value})
+		if user := auth.AdminUser(r); user != "" {
+			t.Errorf("%v: expected no admin but got %q", name, user)
+		}
+	}
+
+	// changing the password logs out existing sessions
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: adminSessionCookieName, Value: valid})
+	auth.users["alice"] = string(auth.dummyHash) + "changed"
+	if user := auth.AdminUser(r); user != "" {
+		t.Errorf("expected a password change to end the session but got %q", user)
+	}
+
+	expired := newTestUserFileAuthenticator(t)
+	expired.lifetime = -time.Minute
+	w = httptest.NewRecorder()
+	expired.Login("alice", "hunter2", w)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: adminSessionCookieName, Value: sessionCookie(w).Value})
+	if user := expired.AdminUser(r); user != "" {
+		t.Errorf("expected an expired session to be refused but got %q", user)
+	}
+}
+
+func TestSafeRedirectTarget(t *testing.T) {
+	cases := map[string]string{
+		"/challenges?page=2":    "/challenges?page=2",
+		"/":                     "/",
+		"":                      "/",
+		"challenges":            "/",
+		"https://evil.example/": "/",
+		"//evil.example/":       "/",
+		"/\\evil.example/":      "/",
+	}
+	for target, expected := range cases {
+		if actual := safeRedirectTarget(target); actual != expected {
+			t.Errorf("%q: expected %q but got %q", target, expected, actual)
+		}
+	}
+}
+
+func TestProxyHeaderOnlyBelievedFromTrustedProxies(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies = []*net.IPNet{proxies}
+	adminAuthenticator = &proxyHeaderAuthenticator{header: "X-Remote-User", proxies: trustedProxies}
+	defer func() {
+		trustedProxies = nil
+		adminAuthenticator = nil
+	}()
+
+	cases := []struct {
+		remoteAddr string
+		forwarded  string
+		user       string
+		expected   int
+	}{
+		{"10.0.0.2:1234", "203.0.113.9", "alice", http.StatusOK},
+		{"10.0.0.2:1234", "203.0.113.9", "", http.StatusUnauthorized},
+		// an untrusted peer can't log in by sending the header itself
+		{"192.0.2.1:1234", "", "alice", http.StatusUnauthorized},
+		// nor by claiming to be forwarded from a trusted proxy
+		{"192.0.2.1:1234", "10.0.0.2", "alice", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		var seen string
+		handler := withClientIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requireAdmin(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+				seen = adminUser(r)
+			})(w, r, nil)
+		}))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if c.user != "" {
+			r.Header.Set("X-Remote-User", c.user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != c.expected {
+			t.Errorf("%v sending %q: expected %d but got %d", c.remoteAddr, c.user, c.expected, w.Code)
+		}
+		if c.expected == http.StatusOK && seen != c.user {
+			t.Errorf("%v: expected admin %q but got %q", c.remoteAddr, c.user, seen)
+		}
+	}
+}
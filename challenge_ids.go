@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+)
+
+const (
+	// challengeIDStyleRandom is a long random token, unguessable but unwieldy.
+	challengeIDStyleRandom = "random"
+	// challengeIDStyleShort is a short code that is easy to read out or type.
+	challengeIDStyleShort = "short"
+	// challengeIDStyleCustom is a slug chosen by whoever shares.
+	challengeIDStyleCustom = "custom"
+)
+
+var challengeIDStyles = []string{challengeIDStyleRandom, challengeIDStyleShort, challengeIDStyleCustom}
+
+const shortChallengeIDLength = 8
+
+// maxChallengeIDAttempts gives up on generating a free ID, which would take
+// a very full repository or a broken random source.
+const maxChallengeIDAttempts = 10
+
+var challengeSlugPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+var errChallengeIDStyle = errors.New("ID style must be random, short or custom")
+var errChallengeSlug = errors.New("custom IDs must be 1 to 64 letters, numbers, - or _, starting with a letter or number")
+
+func isChallengeIDStyle(style string) bool {
+	for _, known := range challengeIDStyles {
+		if style == known {
+			return true
+		}
+	}
+	return false
+}
+
+// shortCodeReplacer undoes the usual ways of mistyping a short code.
+var shortCodeReplacer = strings.NewReplacer("I", "1", "L", "1", "O", "0")
+
+// normalizeShortCode turns what could be a mistyped short code into the code,
+// uppercased and with I, L and O read as the digits they look like.
+// Anything else is returned as is.
+func normalizeShortCode(challengeID string) string {
+	if len(challengeID) != shortChallengeIDLength {
+		return challengeID
+	}
+	code := shortCodeReplacer.Replace(strings.ToUpper(challengeID))
+	if strings.Trim(code, crockfordAlphabet) != "" {
+		return challengeID
+	}
+	return code
+}
+
+// findChallenge looks up challengeID in repo, falling back to the short code
+// it may be a mistyped version of.
+func findChallenge(repo stuff.ChallengeRepository, challengeID string) *stuff.Challenge {
+	if challenge := repo.Get(challengeID); challenge != nil {
+		return challenge
+	}
+	if code := normalizeShortCode(challengeID); code != challengeID {
+		return repo.Get(code)
+	}
+	return nil
+}
+
+func generateChallengeID(config *Config, style string) (string, error) {
+	if style == challengeIDStyleShort {
+		return RandomCode(shortChallengeIDLength)
+	}
+	return RandomString(config.ChallengeIDLength)
+}
+
+// createChallenge gives challenge an ID in the given style and adds it to repo.
+// An empty style means the configured default. Generated IDs that are already
+// taken are replaced by new ones; a taken slug fails with stuff.ErrChallengeIDTaken.
+func createChallenge(repo stuff.ChallengeRepository, config *Config, challenge *stuff.Challenge, style string, slug string) error {
+	if style == "" {
+		style = config.DefaultIDStyle
+	}
+	if !isChallengeIDStyle(style) {
+		return errChallengeIDStyle
+	}
+
+	if style == challengeIDStyleCustom {
+		if !challengeSlugPattern.MatchString(slug) {
+			return errChallengeSlug
+		}
+		challenge.ID = slug
+		return repo.Create(challenge)
+	}
+
+	for i := 0; i < maxChallengeIDAttempts; i++ {
+		challengeID, err := generateChallengeID(config, style)
+		if err != nil {
+			return err
+		}
+
+		challenge.ID = challengeID
+		err = repo.Create(challenge)
+		if err != stuff.ErrChallengeIDTaken {
+			return err
+		}
+	}
+
+	return errors.New("couldn't find a free challenge ID")
+}
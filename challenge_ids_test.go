@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+)
+
+func TestCreateChallengeShortID(t *testing.T) {
+	repo := stuff.NewArrayChallengeRepository()
+
+	challenge := &stuff.Challenge{SharedPath: "/foo"}
+	if err := createChallenge(repo, defaultConfig(), challenge, challengeIDStyleShort, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(challenge.ID) != shortChallengeIDLength {
+		t.Errorf("expected a %d character ID but got %q", shortChallengeIDLength, challenge.ID)
+	}
+	if strings.Trim(challenge.ID, crockfordAlphabet) != "" {
+		t.Errorf("expected only Crockford base32 in %q", challenge.ID)
+	}
+	if repo.Get(challenge.ID) == nil {
+		t.Error("expected the challenge to be saved")
+	}
+}
+
+func TestCreateChallengeCustomID(t *testing.T) {
+	repo := stuff.NewArrayChallengeRepository()
+	config := defaultConfig()
+
+	if err := createChallenge(repo, config, &stuff.Challenge{}, challengeIDStyleCustom, "holiday-photos"); err != nil {
+		t.Fatal(err)
+	}
+	if repo.Get("holiday-photos") == nil {
+		t.Fatal("expected the challenge to be saved under its slug")
+	}
+
+	if err := createChallenge(repo, config, &stuff.Challenge{}, challengeIDStyleCustom, "holiday-photos"); err != stuff.ErrChallengeIDTaken {
+		t.Errorf("expected a taken slug to fail with %v but got %v", stuff.ErrChallengeIDTaken, err)
+	}
+
+	repo.Bury(repo.Get("holiday-photos"))
+	if err := createChallenge(repo, config, &stuff.Challenge{}, challengeIDStyleCustom, "holiday-photos"); err != stuff.ErrChallengeIDTaken {
+		t.Errorf("expected a buried slug to stay taken but got %v", err)
+	}
+
+	for _, slug := range []string{"", "-foo", "foo/bar", "foo bar", "../foo", "föö", strings.Repeat("a", 65)} {
+		if err := createChallenge(repo, config, &stuff.Challenge{}, challengeIDStyleCustom, slug); err != errChallengeSlug {
+			t.Errorf("expected slug %q to be rejected but got %v", slug, err)
+		}
+	}
+}
+
+func TestCreateChallengeUnknownStyle(t *testing.T) {
+	repo := stuff.NewArrayChallengeRepository()
+
+	if err := createChallenge(repo, defaultConfig(), &stuff.Challenge{}, "emoji", ""); err != errChallengeIDStyle {
+		t.Errorf("expected %v but got %v", errChallengeIDStyle, err)
+	}
+}
+
+func TestFindChallengeNormalizesShortCodes(t *testing.T) {
+	repo := stuff.NewArrayChallengeRepository()
+	repo.Set(&stuff.Challenge{ID: "AB1C0D2E"})
+	repo.Set(&stuff.Challenge{ID: "loud-cat"})
+
+	cases := map[string]string{
+		"AB1C0D2E": "AB1C0D2E",
+		"ab1c0d2e": "AB1C0D2E",
+		"ABIC0D2E": "AB1C0D2E",
+		"ablcOd2e": "AB1C0D2E",
+		"loud-cat": "loud-cat",
+		"LOUD-CAT": "",
+		"AB1C0D2U": "",
+		"AB1C0D2":  "",
+	}
+	for lookup, expected := range cases {
+		challenge := findChallenge(repo, lookup)
+		if (challenge == nil && expected != "") || (challenge != nil && challenge.ID != expected) {
+			t.Errorf("%q: expected %q but got %+v", lookup, expected, challenge)
+		}
+	}
+}
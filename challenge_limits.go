@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+)
+
+// throttleSteps is how many writes per second a throttled download is split into,
+// so it keeps an even pace instead of bursting.
+const throttleSteps = 10
+
+// limitedResponseWriter holds a download to its challenge's byte quota and speed limit.
+// Once the quota runs out the download is cut short.
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	challenge *stuff.Challenge
+	start     time.Time
+	written   int64
+}
+
+func newLimitedResponseWriter(w http.ResponseWriter, challenge *stuff.Challenge) http.ResponseWriter {
+	if challenge.MaxServedBytes <= 0 && challenge.MaxBytesPerSecond <= 0 {
+		return w
+	}
+	return &limitedResponseWriter{ResponseWriter: w, challenge: challenge, start: time.Now()}
+}
+
+func (w *limitedResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if rate := w.challenge.MaxBytesPerSecond; rate > 0 && int64(len(chunk)) > rate/throttleSteps+1 {
+			chunk = chunk[:rate/throttleSteps+1]
+		}
+
+		quotaReached := false
+		if w.challenge.MaxServedBytes > 0 {
+			granted := challengeRepository.ReserveChallengeBytes(w.challenge, int64(len(chunk)))
+			if granted < int64(len(chunk)) {
+				quotaReached = true
+				chunk = chunk[:granted]
+			}
+		}
+
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		w.written += int64(n)
+		if w.challenge.MaxServedBytes > 0 && n < len(chunk) {
+			// give back what the client never got
+			challengeRepository.ReserveChallengeBytes(w.challenge, int64(n-len(chunk)))
+		}
+		if err != nil {
+			return written, err
+		}
+		if quotaReached {
+			log.Printf("Challenge %v used up its byte quota, cutting a download short", w.challenge.ID)
+			return written, stuff.ErrChallengeByteQuotaReached
+		}
+
+		p = p[len(chunk):]
+		w.throttle()
+	}
+	return written, nil
+}
+
+// throttle waits until the bytes written so far are within the speed limit.
+func (w *limitedResponseWriter) throttle() {
+	rate := w.challenge.MaxBytesPerSecond
+	if rate <= 0 {
+		return
+	}
+	due := w.start.Add(time.Duration(float64(w.written) / float64(rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+}
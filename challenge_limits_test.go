@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+	"github.com/AlbinoDrought/creamy-stuff/thumbnails"
+)
+
+func TestLimitedResponseWriterCutsOffAtQuota(t *testing.T) {
+	repo := stuff.NewArrayChallengeRepository()
+	challengeRepository = repo
+	challenge := &stuff.Challenge{ID: "quota", MaxServedBytes: 10}
+	repo.Set(challenge)
+
+	recorder := httptest.NewRecorder()
+	w := newLimitedResponseWriter(recorder, challenge)
+	n, err := w.Write(bytes.Repeat([]byte("x"), 25))
+	if n != 10 || err != stuff.ErrChallengeByteQuotaReached {
+		t.Errorf("expected 10 bytes and ErrChallengeByteQuotaReached but got %d, %v", n, err)
+	}
+	if recorder.Body.Len() != 10 || !repo.Get("quota").HitByteQuota() {
+		t.Errorf("expected 10 bytes sent and the quota used up, got %d", recorder.Body.Len())
+	}
+}
+
+func TestLimitedResponseWriterThrottles(t *testing.T) {
+	challenge := &stuff.Challenge{ID: "slow", MaxBytesPerSecond: 1000}
+
+	start := time.Now()
+	w := newLimitedResponseWriter(httptest.NewRecorder(), challenge)
+	if _, err := w.Write(make([]byte, 300)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("expected 300 bytes at 1000 B/s to take about 300ms but took %v", elapsed)
+	}
+}
+
+func TestLimitedPreviewsDontInlineText(t *testing.T) {
+	thumbnailGenerator = &thumbnails.Generator{}
+	defer func() { thumbnailGenerator = nil }()
+
+	resolvedPath := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(resolvedPath, []byte("the secret ingredient"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		counting string
+		limited  bool
+		maxBytes int64
+		throttle int64
+		inlined  bool
+	}{
+		{stuff.ViewCountingFile, false, 0, 0, true},
+		{stuff.ViewCountingFile, true, 0, 0, false},
+		{stuff.ViewCountingDownload, true, 0, 0, false},
+		{stuff.ViewCountingFile, false, 1000, 0, false},
+		{stuff.ViewCountingFile, false, 0, 1000, false},
+	}
+	for _, c := range cases {
+		challenge := &stuff.Challenge{ID: "preview", ViewCounting: c.counting, MaxServedBytes: c.maxBytes, MaxBytesPerSecond: c.throttle}
+		if c.limited {
+			challenge.SetMaxViewCount(1)
+		}
+
+		w := httptest.NewRecorder()
+		handleChallengePreview(w, httptest.NewRequest("GET", "/view/preview/secret.txt", nil), challenge, resolvedPath, "/secret.txt", "secret.txt")
+		if strings.Contains(w.Body.String(), "the secret ingredient") != c.inlined {
+			t.Errorf("%+v: expected the text to be inlined: %v", c, c.inlined)
+		}
+	}
+}
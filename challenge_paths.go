@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/AlbinoDrought/creamy-stuff/safefs"
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+)
+
+// namedFileInfo shows a shared path under its name in a virtual root.
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (info *namedFileInfo) Name() string {
+	return info.name
+}
+
+func isChallengeRoot(filePath string) bool {
+	return filePath == "" || filePath == "/" || filePath == "."
+}
+
+// resolveChallengePath finds where filePath of challenge lives: a filesystem rooted
+// at the shared path it is in, so symlinks can't lead out of the share, and its name there.
+// The virtual root of a multi-path challenge isn't in any filesystem, see challengeRootEntries.
+func resolveChallengePath(challenge *stuff.Challenge, filePath string) (*safefs.FileSystem, string, error) {
+	filePath = path.Clean("/" + filePath)
+	if len(challenge.SharedPaths) == 0 {
+		fsys, err := dataFileSystem.Sub(challenge.SharedPath)
+		return fsys, filePath, err
+	}
+
+	entryName, rest, _ := strings.Cut(strings.TrimPrefix(filePath, "/"), "/")
+	for _, entry := range challenge.SharedEntries() {
+		if entry.Name == entryName {
+			fsys, err := dataFileSystem.Sub(entry.Path)
+			return fsys, "/" + rest, err
+		}
+	}
+	return nil, "", &os.PathError{Op: "open", Path: filePath, Err: os.ErrNotExist}
+}
+
+// challengeRootEntries lists the virtual root of a multi-path challenge.
+// Paths that were deleted or hidden since sharing are left out.
+func challengeRootEntries(challenge *stuff.Challenge) []os.FileInfo {
+	entries := []os.FileInfo{}
+	for _, entry := range challenge.SharedEntries() {
+		resolvedPath, err := dataFileSystem.Resolve(entry.Path)
+		if err != nil {
+			continue
+		}
+		stat, err := os.Stat(resolvedPath)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, &namedFileInfo{FileInfo: stat, name: entry.Name})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// challengeArchiveSources is what goes into an archive of filePath, which may be a virtual root.
+func challengeArchiveSources(challenge *stuff.Challenge, filePath string) ([]archiveSource, error) {
+	if len(challenge.SharedPaths) > 0 && isChallengeRoot(filePath) {
+		sources := []archiveSource{}
+		for _, entry := range challenge.SharedEntries() {
+			fsys, err := dataFileSystem.Sub(entry.Path)
+			if err != nil {
+				// gone since sharing, like in the listing
+				continue
+			}
+			sources = append(sources, archiveSource{fsys: fsys, name: "/", prefix: entry.Name})
+		}
+		return sources, nil
+	}
+
+	fsys, name, err := resolveChallengePath(challenge, filePath)
+	if err != nil {
+		return nil, err
+	}
+	return []archiveSource{{fsys: fsys, name: name}}, nil
+}
+
+// challengeFileName is what filePath of challenge is called when downloaded.
+func challengeFileName(challenge *stuff.Challenge, filePath string) string {
+	filePath = path.Clean("/" + filePath)
+	if filePath != "/" {
+		return path.Base(filePath)
+	}
+	if len(challenge.SharedPaths) == 0 {
+		return path.Base(path.Clean("/" + challenge.SharedPath))
+	}
+	return "/"
+}
+
+// parseSharedPaths cleans the paths picked with "share selected", dropping duplicates.
+func parseSharedPaths(values []string) []string {
+	paths := []string{}
+	seen := map[string]bool{}
+	for _, value := range values {
+		sharedPath := path.Clean("/" + value)
+		if value == "" || seen[sharedPath] {
+			continue
+		}
+		seen[sharedPath] = true
+		paths = append(paths, sharedPath)
+	}
+	return paths
+}
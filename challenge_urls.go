@@ -11,35 +11,162 @@ import (
 type ChallengeURLGenerator interface {
 	ViewChallenge(challenge *stuff.Challenge) string
 	ViewChallengePath(challenge *stuff.Challenge, filePath string) string
+	DownloadChallengeArchive(challenge *stuff.Challenge, filePath string, format string) string
+	ViewChallengeThumbnail(challenge *stuff.Challenge, filePath string) string
+	ViewChallengeRaw(challenge *stuff.Challenge, filePath string) string
+	DownloadChallengeFile(challenge *stuff.Challenge, filePath string) string
 }
 
 type BrowseURLGenerator interface {
 	BrowsePath(filePath string) string
 	SharePath(filePath string) string
+	ThumbnailPath(filePath string) string
+	RawPath(filePath string) string
+	DownloadPath(filePath string) string
+}
+
+// AdminURLGenerator links to the private pages that aren't about browsing files.
+type AdminURLGenerator interface {
+	HomePath() string
+	// LoginPath returns to next after logging in, if it isn't empty.
+	LoginPath(next string) string
+	LogoutPath() string
+	ChallengesPath() string
+	EditChallengePath(challenge *stuff.Challenge) string
+	DeleteChallengePath(challenge *stuff.Challenge) string
+	// ChallengeViewsPath links to the activity page, or an export of it when format is csv or json.
+	ChallengeViewsPath(challenge *stuff.Challenge, format string) string
+	APIChallengePath(challenge *stuff.Challenge) string
 }
 
 func aftermarketEscape(url string) string {
 	return strings.ReplaceAll(url, "=", "%3D")
 }
 
-type hardcodedURLGenerator struct{}
+// configuredURLGenerator makes links to routes mounted under PathPrefix.
+// Links are absolute when BaseURL is set, and public /view/ links use
+// PublicBaseURL instead when that is set too.
+type configuredURLGenerator struct {
+	BaseURL       string
+	PublicBaseURL string
+	PathPrefix    string
+}
+
+// hardcodedURLGenerator makes root-relative links, for when nothing is configured.
+type hardcodedURLGenerator struct {
+	configuredURLGenerator
+}
+
+func newURLGenerator(config *Config) *configuredURLGenerator {
+	return &configuredURLGenerator{
+		BaseURL:       config.BaseURL,
+		PublicBaseURL: config.PublicBaseURL,
+		PathPrefix:    config.PathPrefix,
+	}
+}
+
+// useURLGenerator makes every link follow config.
+func useURLGenerator(config *Config) {
+	urlGenerator := newURLGenerator(config)
+	challengeURLGenerator = urlGenerator
+	browseURLGenerator = urlGenerator
+	adminURLGenerator = urlGenerator
+}
+
+func (generator *configuredURLGenerator) private(routePath string) string {
+	privateURL := url.URL{Path: generator.PathPrefix + routePath}
+	return generator.BaseURL + privateURL.String()
+}
+
+func (generator *configuredURLGenerator) public(routePath string) string {
+	baseURL := generator.PublicBaseURL
+	if baseURL == "" {
+		baseURL = generator.BaseURL
+	}
+	publicURL := url.URL{Path: generator.PathPrefix + routePath}
+	return baseURL + aftermarketEscape(publicURL.String())
+}
+
+func (generator *configuredURLGenerator) ViewChallenge(challenge *stuff.Challenge) string {
+	return generator.public("/view/" + challenge.ID)
+}
+
+func (generator *configuredURLGenerator) ViewChallengePath(challenge *stuff.Challenge, filePath string) string {
+	return generator.public("/view/" + challenge.ID + "/" + path.Clean(filePath))
+}
+
+func (generator *configuredURLGenerator) DownloadChallengeArchive(challenge *stuff.Challenge, filePath string, format string) string {
+	query := url.Values{"archive": {format}}
+	return generator.ViewChallengePath(challenge, filePath) + "?" + query.Encode()
+}
+
+func (generator *configuredURLGenerator) ViewChallengeThumbnail(challenge *stuff.Challenge, filePath string) string {
+	// public routes stay under /view/ so reverse proxies only need to expose that prefix
+	return generator.ViewChallengePath(challenge, filePath) + "?thumbnail=1"
+}
+
+func (generator *configuredURLGenerator) ViewChallengeRaw(challenge *stuff.Challenge, filePath string) string {
+	return generator.ViewChallengePath(challenge, filePath) + "?raw=1"
+}
+
+func (generator *configuredURLGenerator) DownloadChallengeFile(challenge *stuff.Challenge, filePath string) string {
+	return generator.ViewChallengePath(challenge, filePath) + "?download=1"
+}
+
+func (generator *configuredURLGenerator) BrowsePath(filePath string) string {
+	return generator.private("/stuff/browse" + path.Clean(filePath))
+}
+
+func (generator *configuredURLGenerator) SharePath(filePath string) string {
+	return generator.private("/stuff/share" + path.Clean(filePath))
+}
+
+func (generator *configuredURLGenerator) ThumbnailPath(filePath string) string {
+	return generator.private("/stuff/thumbnail" + path.Clean(filePath))
+}
+
+func (generator *configuredURLGenerator) RawPath(filePath string) string {
+	return generator.BrowsePath(filePath) + "?raw=1"
+}
+
+func (generator *configuredURLGenerator) DownloadPath(filePath string) string {
+	return generator.BrowsePath(filePath) + "?download=1"
+}
+
+func (generator *configuredURLGenerator) HomePath() string {
+	return generator.private("/")
+}
+
+func (generator *configuredURLGenerator) LoginPath(next string) string {
+	if next == "" {
+		return generator.private("/login")
+	}
+	return generator.private("/login") + "?" + url.Values{"next": {next}}.Encode()
+}
+
+func (generator *configuredURLGenerator) LogoutPath() string {
+	return generator.private("/logout")
+}
+
+func (generator *configuredURLGenerator) ChallengesPath() string {
+	return generator.private("/challenges")
+}
 
-func (generator *hardcodedURLGenerator) ViewChallenge(challenge *stuff.Challenge) string {
-	challengeURL := url.URL{Path: "/view/" + challenge.ID}
-	return aftermarketEscape(challengeURL.String())
+func (generator *configuredURLGenerator) EditChallengePath(challenge *stuff.Challenge) string {
+	return generator.private("/challenges/" + challenge.ID + "/edit")
 }
 
-func (generator *hardcodedURLGenerator) ViewChallengePath(challenge *stuff.Challenge, filePath string) string {
-	browseURL := url.URL{Path: "/view/" + challenge.ID + "/" + path.Clean(filePath)}
-	return aftermarketEscape(browseURL.String())
+func (generator *configuredURLGenerator) DeleteChallengePath(challenge *stuff.Challenge) string {
+	return generator.private("/challenges/" + challenge.ID + "/delete")
 }
 
-func (generator *hardcodedURLGenerator) BrowsePath(filePath string) string {
-	browseURL := url.URL{Path: "/stuff/browse" + path.Clean(filePath)}
-	return browseURL.String()
+func (generator *configuredURLGenerator) ChallengeViewsPath(challenge *stuff.Challenge, format string) string {
+	if format == "" {
+		return generator.private("/challenges/" + challenge.ID + "/views")
+	}
+	return generator.private("/challenges/"+challenge.ID+"/views") + "?format=" + url.QueryEscape(format)
 }
 
-func (generator *hardcodedURLGenerator) SharePath(filePath string) string {
-	browseURL := url.URL{Path: "/stuff/share" + path.Clean(filePath)}
-	return browseURL.String()
+func (generator *configuredURLGenerator) APIChallengePath(challenge *stuff.Challenge) string {
+	return generator.private("/api/v1/challenges/" + challenge.ID)
 }
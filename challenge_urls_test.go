@@ -19,3 +19,60 @@ func TestViewChallenge(t *testing.T) {
 		t.Errorf("expected %s but got %s", expected, actual)
 	}
 }
+
+func TestDownloadChallengeArchive(t *testing.T) {
+	challenge := &stuff.Challenge{
+		ID: "foo==",
+	}
+
+	generator := &hardcodedURLGenerator{}
+	expected := "/view/foo%3D%3D/bar?archive=tar.gz"
+	actual := generator.DownloadChallengeArchive(challenge, "bar", "tar.gz")
+
+	if actual != expected {
+		t.Errorf("expected %s but got %s", expected, actual)
+	}
+}
+
+func TestConfiguredURLGenerator(t *testing.T) {
+	challenge := &stuff.Challenge{
+		ID: "foo==",
+	}
+
+	generator := &configuredURLGenerator{
+		BaseURL:       "https://admin.example.com",
+		PublicBaseURL: "https://share.example.com",
+		PathPrefix:    "/creamy",
+	}
+
+	tests := []struct {
+		actual   string
+		expected string
+	}{
+		{generator.ViewChallenge(challenge), "https://share.example.com/creamy/view/foo%3D%3D"},
+		{generator.ViewChallengeRaw(challenge, "bar baz"), "https://share.example.com/creamy/view/foo%3D%3D/bar%20baz?raw=1"},
+		{generator.BrowsePath("/bar"), "https://admin.example.com/creamy/stuff/browse/bar"},
+		{generator.HomePath(), "https://admin.example.com/creamy/"},
+		{generator.LoginPath("/creamy/challenges?page=2"), "https://admin.example.com/creamy/login?next=%2Fcreamy%2Fchallenges%3Fpage%3D2"},
+		{generator.ChallengeViewsPath(challenge, "csv"), "https://admin.example.com/creamy/challenges/foo==/views?format=csv"},
+	}
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Errorf("expected %s but got %s", test.expected, test.actual)
+		}
+	}
+}
+
+func TestConfiguredURLGeneratorPublicDefaultsToBase(t *testing.T) {
+	challenge := &stuff.Challenge{
+		ID: "foo",
+	}
+
+	generator := &configuredURLGenerator{BaseURL: "https://files.example.com"}
+	expected := "https://files.example.com/view/foo"
+	actual := generator.ViewChallenge(challenge)
+
+	if actual != expected {
+		t.Errorf("expected %s but got %s", expected, actual)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+	"github.com/AlbinoDrought/creamy-stuff/templates"
+	"github.com/julienschmidt/httprouter"
+)
+
+// responseRecorder remembers the status and size of a response for the activity log.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	failed bool
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *responseRecorder) Write(p []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	n, err := recorder.ResponseWriter.Write(p)
+	recorder.bytes += int64(n)
+	if err != nil {
+		recorder.failed = true
+	}
+	return n, err
+}
+
+// complete checks if the response went through to the end of the file,
+// either whole or as the last part of a range request.
+func (recorder *responseRecorder) complete() bool {
+	if recorder.failed {
+		return false
+	}
+
+	header := recorder.Header()
+	switch recorder.status {
+	case http.StatusOK:
+		// archives are streamed without a length
+		length := header.Get("Content-Length")
+		return length == "" || length == strconv.FormatInt(recorder.bytes, 10)
+	case http.StatusPartialContent:
+		var start, end, size int64
+		if _, err := fmt.Sscanf(header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil {
+			return false
+		}
+		return end == size-1 && recorder.bytes == end-start+1
+	}
+	return false
+}
+
+// ensureVisitor gives the visitor a random ID for view counting, if they don't have one yet.
+func ensureVisitor(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(stuff.VisitorCookieName); err == nil && cookie.Value != "" {
+		return
+	}
+
+	visitorID, err := RandomString(16)
+	if err != nil {
+		log.Printf("Error generating visitor ID: %v", err)
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     stuff.VisitorCookieName,
+		Path:     "/",
+		Value:    visitorID,
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, cookie)
+	// count this first request under the new ID too
+	r.AddCookie(cookie)
+}
+
+// serveChallengeView reserves a view of filePath, lets serve write the response,
+// then logs its status and size. It renders an error and returns false if no view is left.
+func serveChallengeView(w http.ResponseWriter, r *http.Request, challenge *stuff.Challenge, filePath string, serve func(w http.ResponseWriter)) bool {
+	// log "/" rather than "." for the shared folder itself
+	filePath = path.Clean("/" + filePath)
+
+	// a multipart response of several ranges can add up to the whole file without
+	// looking like it, so send the whole file instead and count it like one
+	if stuff.HasSeveralRanges(r) {
+		r.Header.Del("Range")
+	}
+
+	ensureVisitor(w, r)
+	view, err := challengeRepository.ReserveChallengeView(challenge, filePath, r)
+	if err != nil {
+		log.Printf("Error reserving view of %v for challenge %v: %v", filePath, challenge.ID, err)
+		renderUnauthorized(w, r)
+		return false
+	}
+
+	recorder := &responseRecorder{ResponseWriter: newLimitedResponseWriter(w, challenge)}
+	serve(recorder)
+
+	if recorder.status != http.StatusPartialContent {
+		// the range wasn't served, so whatever was sent started at the beginning
+		view.Offset = 0
+	}
+	view.Bytes = recorder.bytes
+	view.Status = recorder.status
+	view.Complete = recorder.complete()
+	challengeRepository.CompleteChallengeView(challenge, view)
+	return true
+}
+
+// summarizeChallengeViews counts views and bytes per day, oldest first, and per file, most viewed first.
+// Wrong password guesses are counted separately.
+func summarizeChallengeViews(views []*stuff.ChallengeView) ([]templates.ViewSummary, []templates.ViewSummary, int) {
+	days := map[string]*templates.ViewSummary{}
+	files := map[string]*templates.ViewSummary{}
+
+	add := func(summaries map[string]*templates.ViewSummary, label string, view *stuff.ChallengeView) {
+		summary, exists := summaries[label]
+		if !exists {
+			summary = &templates.ViewSummary{Label: label}
+			summaries[label] = summary
+		}
+		summary.Views++
+		summary.Bytes += view.Bytes
+	}
+	failedUnlocks := 0
+	for _, view := range views {
+		if view.FailedUnlock {
+			failedUnlocks++
+			continue
+		}
+		add(days, view.Time.Local().Format("2006-01-02"), view)
+		add(files, view.FilePath, view)
+	}
+
+	flatten := func(summaries map[string]*templates.ViewSummary) []templates.ViewSummary {
+		flattened := make([]templates.ViewSummary, 0, len(summaries))
+		for _, summary := range summaries {
+			flattened = append(flattened, *summary)
+		}
+		return flattened
+	}
+
+	daySummaries := flatten(days)
+	sort.Slice(daySummaries, func(i, j int) bool { return daySummaries[i].Label < daySummaries[j].Label })
+
+	fileSummaries := flatten(files)
+	sort.Slice(fileSummaries, func(i, j int) bool {
+		if fileSummaries[i].Views != fileSummaries[j].Views {
+			return fileSummaries[i].Views > fileSummaries[j].Views
+		}
+		return fileSummaries[i].Label < fileSummaries[j].Label
+	})
+
+	return daySummaries, fileSummaries, failedUnlocks
+}
+
+func writeChallengeViewsCSV(w http.ResponseWriter, challenge *stuff.Challenge) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"views-%s.csv\"", challenge.ID))
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"time", "ip", "file_path", "upload", "failed_unlock", "user_agent", "bytes", "status", "network_rule", "counted", "complete"})
+	for _, view := range challenge.Views() {
+		writer.Write([]string{
+			view.Time.Format(time.RFC3339),
+			view.IP,
+			view.FilePath,
+			strconv.FormatBool(view.Upload),
+			strconv.FormatBool(view.FailedUnlock),
+			view.UserAgent,
+			strconv.FormatInt(view.Bytes, 10),
+			strconv.Itoa(view.Status),
+			view.NetworkRule,
+			strconv.FormatBool(!view.Uncounted),
+			strconv.FormatBool(view.Complete),
+		})
+	}
+	writer.Flush()
+
+	if err := writer.Error(); err != nil {
+		log.Printf("Error writing views of challenge %v as CSV: %v", challenge.ID, err)
+	}
+}
+
+func handleChallengeViews(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	challengeID := ps.ByName("challenge")
+
+	challenge := challengeRepository.Get(challengeID)
+	if challenge == nil {
+		renderChallengeNotFound(w, r, challengeID)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "csv":
+		writeChallengeViewsCSV(w, challenge)
+		return
+	case "json":
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"views-%s.json\"", challenge.ID))
+		writeAPIJSON(w, http.StatusOK, newAPIChallengeViews(challenge.Views()))
+		return
+	}
+
+	views := challenge.Views()
+	days, files, failedUnlocks := summarizeChallengeViews(views)
+
+	// newest first, like a log
+	newestFirst := make([]*stuff.ChallengeView, len(views))
+	for i, view := range views {
+		newestFirst[len(views)-1-i] = view
+	}
+
+	templates.WritePageTemplate(w, &templates.ChallengeViewsPage{
+		Challenge: challenge,
+		Views:     newestFirst,
+		Days:      days,
+		Files:     files,
+
+		FailedUnlocks: failedUnlocks,
+
+		ViewLink: challengeURLGenerator.ViewChallenge(challenge),
+		EditLink: adminURLGenerator.EditChallengePath(challenge),
+		CSVLink:  adminURLGenerator.ChallengeViewsPath(challenge, "csv"),
+		JSONLink: adminURLGenerator.ChallengeViewsPath(challenge, "json"),
+	}, privateNav(r))
+}
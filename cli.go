@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+	"github.com/AlbinoDrought/creamy-stuff/templates"
+)
+
+const usage = `Usage: %[1]s <command> [flags]
+
+Commands:
+  serve                       serve the web UI (default)
+  share create <path>         share a file or folder under the data directory
+        -password <password>  require a password
+        -expires <when>       expire after a duration like 72h, or at a time like "2030-01-02 15:04"
+        -valid-from <when>    don't open until after a duration like 72h, or a time like "2030-01-02 15:04"
+        -max-views <count>    stop working after this many views
+        -view-limit-per-file  apply -max-views to each file instead of the whole share
+        -view-counting <policy>
+                              count views per request, file or download (default request)
+        -max-served-megabytes <mb>
+                              stop working after this much has been downloaded
+        -max-kilobytes-per-second <kb>
+                              throttle each download to this speed
+        -public               don't require a password
+        -allow <networks>     only open from these comma-separated CIDRs
+        -deny <networks>      never open from these comma-separated CIDRs
+        -note <text>          remind yourself who the share is for
+  share list                  list shares
+  share revoke <id>           delete a share
+  share views <id>            list a share's views
+
+Every command also takes the server's config flags, see "%[1]s serve -h".
+`
+
+func runCommand(name string, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return serve(name, args)
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "serve":
+		return serve(name+" serve", args)
+	case "share":
+		return runShareCommand(name+" share", args)
+	case "help":
+		fmt.Fprintf(os.Stderr, usage, name)
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, usage, name)
+	return fmt.Errorf("unknown command %q", command)
+}
+
+func runShareCommand(name string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected share create, list, revoke or views")
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "create":
+		return runShareCreate(name+" create", args)
+	case "list":
+		return runShareList(name+" list", args)
+	case "revoke":
+		return runShareRevoke(name+" revoke", args)
+	case "views":
+		return runShareViews(name+" views", args)
+	}
+
+	return fmt.Errorf("unknown share command %q", command)
+}
+
+// parseWhen accepts either a duration from now or an absolute local time.
+func parseWhen(value string) (time.Time, error) {
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(duration), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02"} {
+		if parsed, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return parsed, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("can't parse time %q, expected a duration like 72h or a time like \"2006-01-02 15:04\"", value)
+}
+
+func runShareCreate(name string, args []string) error {
+	var password, expires, validFrom, note, idStyle, customID, allow, deny, viewCounting string
+	var maxViews int
+	var maxServedMegabytes, maxKilobytesPerSecond int64
+	var public, viewLimitPerFile bool
+
+	cliConfig, positional, err := loadConfig(name, args, func(fs *flag.FlagSet) {
+		fs.StringVar(&password, "password", "", "require a password")
+		fs.StringVar(&expires, "expires", "", "expire after a duration like 72h, or at a time like \"2030-01-02 15:04\"")
+		fs.StringVar(&validFrom, "valid-from", "", "don't open until after a duration like 72h, or a time like \"2030-01-02 15:04\"")
+		fs.Int64Var(&maxServedMegabytes, "max-served-megabytes", 0, "stop working after this much has been downloaded")
+		fs.Int64Var(&maxKilobytesPerSecond, "max-kilobytes-per-second", 0, "throttle each download to this speed")
+		fs.IntVar(&maxViews, "max-views", 0, "stop working after this many views")
+		fs.BoolVar(&viewLimitPerFile, "view-limit-per-file", false, "apply -max-views to each file instead of the whole share")
+		fs.StringVar(&viewCounting, "view-counting", stuff.ViewCountingRequest, "count views per request, file or download")
+		fs.BoolVar(&public, "public", false, "don't require a password")
+		fs.StringVar(&allow, "allow", "", "only open from these comma-separated CIDRs")
+		fs.StringVar(&deny, "deny", "", "never open from these comma-separated CIDRs")
+		fs.StringVar(&note, "note", "", "remind yourself who the share is for")
+		fs.StringVar(&idStyle, "id-style", "", "random, short or custom (default <default-id-style>)")
+		fs.StringVar(&customID, "id", "", "custom ID for the link, implies -id-style custom")
+	})
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("expected exactly one path to share")
+	}
+	if maxViews < 0 || maxServedMegabytes < 0 || maxKilobytesPerSecond < 0 {
+		return errors.New("limits must not be negative")
+	}
+	if !stuff.IsViewCounting(viewCounting) {
+		return errViewCounting
+	}
+
+	filePath := path.Clean("/" + positional[0])
+	file, err := cliConfig.FileSystem().Open(filePath)
+	if err != nil {
+		return fmt.Errorf("can't share %s: %w", filePath, err)
+	}
+	file.Close()
+
+	if customID != "" && idStyle == "" {
+		idStyle = challengeIDStyleCustom
+	}
+
+	challenge := &stuff.Challenge{
+		Public:     public,
+		SharedPath: filePath,
+		Note:       note,
+	}
+	if password != "" {
+		if err := challenge.SetPassword(password); err != nil {
+			return fmt.Errorf("setting challenge password: %w", err)
+		}
+	}
+	if expires != "" {
+		expirationDate, err := parseWhen(expires)
+		if err != nil {
+			return err
+		}
+		challenge.SetExpirationDate(expirationDate)
+	}
+	if validFrom != "" {
+		validFromDate, err := parseWhen(validFrom)
+		if err != nil {
+			return err
+		}
+		challenge.SetValidFrom(validFromDate)
+	}
+	if challenge.AllowedNetworks, err = stuff.ParseNetworks(allow); err != nil {
+		return fmt.Errorf("allow: %w", err)
+	}
+	if challenge.DeniedNetworks, err = stuff.ParseNetworks(deny); err != nil {
+		return fmt.Errorf("deny: %w", err)
+	}
+	if maxViews > 0 {
+		challenge.SetMaxViewCount(maxViews)
+		challenge.ViewLimitPerFile = viewLimitPerFile
+	}
+	if viewCounting != stuff.ViewCountingRequest {
+		challenge.ViewCounting = viewCounting
+	}
+	challenge.MaxServedBytes = maxServedMegabytes * 1024 * 1024
+	challenge.MaxBytesPerSecond = maxKilobytesPerSecond * 1024
+	if !challenge.Public && !challenge.HasPassword {
+		fmt.Fprintln(os.Stderr, "Warning: this share is neither public nor password-protected, so nobody can open it")
+	}
+
+	repo, err := openChallengeRepository(cliConfig)
+	if err != nil {
+		return err
+	}
+	if err := createChallenge(repo, cliConfig, challenge, idStyle, customID); err != nil {
+		return fmt.Errorf("creating share: %w", err)
+	}
+
+	useURLGenerator(cliConfig)
+	fmt.Println(challengeURLGenerator.ViewChallenge(challenge))
+	return nil
+}
+
+func runShareList(name string, args []string) error {
+	cliConfig, _, err := loadConfig(name, args, nil)
+	if err != nil {
+		return err
+	}
+	useURLGenerator(cliConfig)
+
+	repo, err := openChallengeRepository(cliConfig)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPATH\tVIEWS\tSTATUS\tLINK")
+	for offset := 0; ; offset += 100 {
+		challenges := repo.All(100, offset)
+		for _, challenge := range challenges {
+			views := fmt.Sprintf("%d", challenge.ViewCount)
+			if challenge.HasViewCountLimit {
+				views += fmt.Sprintf("/%d", challenge.MaxViewCount)
+				if challenge.ViewLimitPerFile {
+					views += " per file"
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", challenge.ID, challenge.DisplayPath(), views, challengeStatus(challenge), challengeURLGenerator.ViewChallenge(challenge))
+		}
+		if len(challenges) < 100 {
+			break
+		}
+	}
+	return w.Flush()
+}
+
+// challengeStatus summarizes a challenge's flags for the command line.
+func challengeStatus(challenge *stuff.Challenge) string {
+	status := []string{}
+	if challenge.Disabled {
+		status = append(status, "disabled")
+	}
+	if challenge.Archived {
+		status = append(status, "archived")
+	}
+	if challenge.NotYetValid() {
+		status = append(status, "from "+challenge.ValidFrom.Local().Format("2006-01-02 15:04"))
+	}
+	if challenge.Expired() {
+		status = append(status, "expired")
+	} else if challenge.Expires {
+		status = append(status, "expires "+challenge.ValidUntil.Local().Format("2006-01-02 15:04"))
+	}
+	if challenge.HasNetworkRules() {
+		status = append(status, "network rules")
+	}
+	if challenge.HitMaxViewCount() {
+		status = append(status, "hit max views")
+	}
+	if challenge.HitByteQuota() {
+		status = append(status, "hit byte quota")
+	}
+	if challenge.Public {
+		status = append(status, "public")
+	}
+	if challenge.HasPassword {
+		status = append(status, "password")
+	}
+	return strings.Join(status, ", ")
+}
+
+func loadChallengeFromArgs(name string, args []string) (stuff.ChallengeRepository, *stuff.Challenge, error) {
+	cliConfig, positional, err := loadConfig(name, args, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(positional) != 1 {
+		return nil, nil, errors.New("expected exactly one share ID")
+	}
+
+	repo, err := openChallengeRepository(cliConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	challenge := findChallenge(repo, positional[0])
+	if challenge == nil {
+		return nil, nil, fmt.Errorf("share %s not found", positional[0])
+	}
+
+	return repo, challenge, nil
+}
+
+func runShareRevoke(name string, args []string) error {
+	repo, challenge, err := loadChallengeFromArgs(name, args)
+	if err != nil {
+		return err
+	}
+
+	repo.Bury(challenge)
+	fmt.Printf("Revoked %s\n", challenge.ID)
+	return nil
+}
+
+func runShareViews(name string, args []string) error {
+	_, challenge, err := loadChallengeFromArgs(name, args)
+	if err != nil {
+		return err
+	}
+
+	return writeShareViews(os.Stdout, challenge.Views())
+}
+
+// writeShareViews lists views like the log on the web activity page.
+func writeShareViews(out io.Writer, views []*stuff.ChallengeView) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tIP\tFILE\tBYTES\tSTATUS\tUSER AGENT")
+	for _, view := range views {
+		ip := view.IP
+		if view.NetworkRule != "" {
+			ip += " (" + view.NetworkRule + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", view.Time.Local().Format(time.RFC3339), ip, view.FilePath, templates.FormatBytes(view.Bytes), viewStatus(view), view.UserAgent)
+	}
+	return w.Flush()
+}
+
+// viewStatus summarizes what happened in a view for the command line.
+func viewStatus(view *stuff.ChallengeView) string {
+	status := []string{}
+	if view.Upload {
+		status = append(status, "upload")
+	} else if view.FailedUnlock {
+		status = append(status, "wrong password")
+	} else if view.Status != 0 {
+		status = append(status, strconv.Itoa(view.Status))
+		if view.Complete {
+			status = append(status, "complete")
+		}
+	}
+	if !view.Upload && !view.FailedUnlock && view.Uncounted {
+		status = append(status, "not counted")
+	}
+	return strings.Join(status, ", ")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+)
+
+func TestWriteShareViews(t *testing.T) {
+	now := time.Now()
+	views := []*stuff.ChallengeView{
+		{Time: now, IP: "192.0.2.1", FilePath: "/a.txt", UserAgent: "curl/8.0", Bytes: 2048, Status: 200, Complete: true, NetworkRule: "192.0.2.0/24"},
+		{Time: now, IP: "192.0.2.2", FilePath: "/b.txt", Bytes: 512, Status: 206, Uncounted: true},
+		{Time: now, IP: "192.0.2.3", FilePath: "/c.txt", Upload: true, Bytes: 10},
+		{Time: now, IP: "192.0.2.4", FilePath: "/", FailedUnlock: true},
+	}
+
+	var out bytes.Buffer
+	if err := writeShareViews(&out, views); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected a header and 4 views but got %q", out.String())
+	}
+	expected := [][]string{
+		{"TIME", "IP", "FILE", "BYTES", "STATUS", "USER AGENT"},
+		{"192.0.2.1 (192.0.2.0/24)", "/a.txt", "2.0 KiB", "200, complete", "curl/8.0"},
+		{"/b.txt", "512 B", "206, not counted"},
+		{"/c.txt", "10 B", "upload"},
+		{"192.0.2.4", "wrong password"},
+	}
+	for i, fields := range expected {
+		for _, field := range fields {
+			if !strings.Contains(lines[i], field) {
+				t.Errorf("line %d: expected %q in %q", i, field, lines[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-stuff/safefs"
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+)
+
+const envPrefix = "CREAMY_"
+
+// Config holds every runtime setting. Values are resolved in this order,
+// later sources winning: defaults, config file, environment, flags.
+type Config struct {
+	DataDirectory  string
+	StateDirectory string
+	ListenAddress  string
+
+	BaseURL       string
+	PublicBaseURL string
+	PathPrefix    string
+	// TrustedProxies are comma-separated networks whose X-Forwarded-For is believed
+	TrustedProxies string
+
+	Symlinks     string
+	HideDotfiles bool
+	Ignore       string
+
+	ChallengeIDLength             int
+	ChallengeRandomPasswordLength int
+
+	SessionLifetime time.Duration
+
+	UnlockMaxAttempts          int
+	UnlockMaxChallengeAttempts int
+	UnlockLockout              time.Duration
+	UnlockMaxLockout           time.Duration
+
+	AdminAuth            string
+	AdminUsersFile       string
+	AdminProxyHeader     string
+	AdminSessionLifetime time.Duration
+
+	APITokensFile string
+
+	ThumbnailSize int
+	FFmpeg        string
+
+	DefaultIDStyle      string
+	DefaultPublic       bool
+	DefaultExpiresAfter time.Duration
+	DefaultMaxViewCount int
+
+	JanitorInterval  time.Duration
+	JanitorRetention time.Duration
+	JanitorAction    string
+
+	LoadDemoFixtures bool
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		DataDirectory:  "data",
+		StateDirectory: "state",
+		ListenAddress:  ":8080",
+
+		Symlinks:     safefs.SymlinksFollow,
+		HideDotfiles: true,
+
+		ChallengeIDLength:             64,
+		ChallengeRandomPasswordLength: 128,
+
+		SessionLifetime: time.Hour,
+
+		UnlockMaxAttempts:          5,
+		UnlockMaxChallengeAttempts: 100,
+		UnlockLockout:              time.Minute,
+		UnlockMaxLockout:           time.Hour,
+
+		AdminAuth:            adminAuthUsers,
+		AdminProxyHeader:     "X-Forwarded-User",
+		AdminSessionLifetime: 24 * time.Hour,
+
+		ThumbnailSize: 256,
+		FFmpeg:        "ffmpeg",
+
+		DefaultIDStyle: challengeIDStyleRandom,
+
+		JanitorInterval:  10 * time.Minute,
+		JanitorRetention: 30 * 24 * time.Hour,
+		JanitorAction:    janitorActionArchive,
+	}
+}
+
+// SessionKeyPath is the file holding the key unlock sessions are signed with.
+func (config *Config) SessionKeyPath() string {
+	return path.Join(config.StateDirectory, "session.key")
+}
+
+// ThumbnailsPath is the directory generated thumbnails are cached in.
+func (config *Config) ThumbnailsPath() string {
+	return path.Join(config.StateDirectory, "thumbnails")
+}
+
+// ChallengesPath is the file the challenge repository is persisted to.
+func (config *Config) ChallengesPath() string {
+	return path.Join(config.StateDirectory, "challenges.json")
+}
+
+// IgnoreGlobs splits the comma-separated ignore setting.
+func (config *Config) IgnoreGlobs() []string {
+	globs := []string{}
+	for _, glob := range strings.Split(config.Ignore, ",") {
+		if glob = strings.TrimSpace(glob); glob != "" {
+			globs = append(globs, glob)
+		}
+	}
+	return globs
+}
+
+// TrustedProxyNetworks parses the trusted proxies setting, separated by commas or whitespace.
+func (config *Config) TrustedProxyNetworks() ([]*net.IPNet, error) {
+	values, err := stuff.ParseNetworks(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	networks := []*net.IPNet{}
+	for _, value := range values {
+		network, err := stuff.ParseNetwork(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// FileSystem is the data directory, with symlinks and hidden files handled as configured.
+func (config *Config) FileSystem() *safefs.FileSystem {
+	return &safefs.FileSystem{
+		Root:         config.DataDirectory,
+		Symlinks:     config.Symlinks,
+		HideDotfiles: config.HideDotfiles,
+		Ignore:       config.IgnoreGlobs(),
+	}
+}
+
+func (config *Config) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	fs.String("config", "", "path to a config file of \"key = value\" lines using these flag names")
+
+	fs.StringVar(&config.DataDirectory, "data-directory", config.DataDirectory, "directory to browse and share files from")
+	fs.StringVar(&config.StateDirectory, "state-directory", config.StateDirectory, "directory to persist shares and other state to")
+	fs.StringVar(&config.ListenAddress, "listen-address", config.ListenAddress, "address to serve HTTP on")
+
+	fs.StringVar(&config.BaseURL, "base-url", config.BaseURL, "scheme and host the server is reached at, like https://files.example.com, to make links absolute")
+	fs.StringVar(&config.PublicBaseURL, "public-base-url", config.PublicBaseURL, "scheme and host for shared /view/ links, if they are served from a different host than the admin pages (default <base-url>)")
+	fs.StringVar(&config.PathPrefix, "path-prefix", config.PathPrefix, "path every route is served under, like /stuff, when mounted below the root by a reverse proxy")
+	fs.StringVar(&config.TrustedProxies, "trusted-proxies", config.TrustedProxies, "comma-separated networks like 10.0.0.0/8 of reverse proxies whose X-Forwarded-For header is trusted")
+
+	fs.StringVar(&config.Symlinks, "symlinks", config.Symlinks, "what to do with symlinks in the data directory: follow (only if they stay inside it) or deny")
+	fs.BoolVar(&config.HideDotfiles, "hide-dotfiles", config.HideDotfiles, "hide files and directories starting with a dot from listings, downloads and archives")
+	fs.StringVar(&config.Ignore, "ignore", config.Ignore, "comma-separated globs of files to hide, like \"*.tmp,node_modules\"")
+
+	fs.IntVar(&config.ChallengeIDLength, "challenge-id-length", config.ChallengeIDLength, "random bytes in generated share IDs")
+	fs.IntVar(&config.ChallengeRandomPasswordLength, "challenge-random-password-length", config.ChallengeRandomPasswordLength, "random bytes in suggested share passwords")
+
+	fs.DurationVar(&config.SessionLifetime, "session-lifetime", config.SessionLifetime, "how long an unlocked password-protected share stays unlocked")
+
+	fs.IntVar(&config.UnlockMaxAttempts, "unlock-max-attempts", config.UnlockMaxAttempts, "wrong share passwords allowed per IP, or IPv6 /64, before locking it out, 0 to never lock out")
+	fs.IntVar(&config.UnlockMaxChallengeAttempts, "unlock-max-challenge-attempts", config.UnlockMaxChallengeAttempts, "wrong passwords for one share allowed from all IPs together before locking everyone out, 0 to never lock out")
+	fs.DurationVar(&config.UnlockLockout, "unlock-lockout", config.UnlockLockout, "how long the first lockout lasts, doubling with every further wrong password")
+	fs.DurationVar(&config.UnlockMaxLockout, "unlock-max-lockout", config.UnlockMaxLockout, "longest lockout, also how long wrong passwords are remembered")
+
+	fs.StringVar(&config.AdminAuth, "admin-auth", config.AdminAuth, "how admins sign in: users (login with the users file), proxy (trust the proxy header) or none")
+	fs.StringVar(&config.AdminUsersFile, "admin-users-file", config.AdminUsersFile, "file of username:bcrypt-hash lines, created with a random admin password if missing (default <state-directory>/admin-users)")
+	fs.StringVar(&config.AdminProxyHeader, "admin-proxy-header", config.AdminProxyHeader, "header a trusted reverse proxy puts the authenticated username in")
+	fs.DurationVar(&config.AdminSessionLifetime, "admin-session-lifetime", config.AdminSessionLifetime, "how long an admin login lasts")
+
+	fs.StringVar(&config.APITokensFile, "api-tokens-file", config.APITokensFile, "file of name:token lines allowed to use the JSON API (default <state-directory>/api-tokens)")
+
+	fs.IntVar(&config.ThumbnailSize, "thumbnail-size", config.ThumbnailSize, "maximum width and height of thumbnails in pixels")
+	fs.StringVar(&config.FFmpeg, "ffmpeg", config.FFmpeg, "ffmpeg binary used for video thumbnails, empty to disable them")
+
+	fs.StringVar(&config.DefaultIDStyle, "default-id-style", config.DefaultIDStyle, "pre-select the share ID style: random (long token), short (8 easy to read characters) or custom")
+	fs.BoolVar(&config.DefaultPublic, "default-public", config.DefaultPublic, "pre-check the public option when sharing")
+	fs.DurationVar(&config.DefaultExpiresAfter, "default-expires-after", config.DefaultExpiresAfter, "pre-fill share expiry this far in the future, 0 to not expire by default")
+	fs.IntVar(&config.DefaultMaxViewCount, "default-max-view-count", config.DefaultMaxViewCount, "pre-fill share max view count, 0 for no limit by default")
+
+	fs.DurationVar(&config.JanitorInterval, "janitor-interval", config.JanitorInterval, "how often to clean up expired and used up shares, 0 to never")
+	fs.DurationVar(&config.JanitorRetention, "janitor-retention", config.JanitorRetention, "how long dead shares are left alone before being cleaned up")
+	fs.StringVar(&config.JanitorAction, "janitor-action", config.JanitorAction, "what cleaning up does: archive (hide from the shares list) or delete (keep only a tombstone)")
+
+	fs.BoolVar(&config.LoadDemoFixtures, "load-demo-fixtures", config.LoadDemoFixtures, "seed the demo shares foo, bar, foobar and floof")
+
+	fs.VisitAll(func(f *flag.Flag) {
+		f.Usage += fmt.Sprintf(" (env %s)", envName(f.Name))
+	})
+
+	return fs
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func readConfigFile(filePath string) (map[string]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", filePath, lineNumber)
+		}
+		values[strings.TrimSpace(parts[0])] = strings.Trim(strings.TrimSpace(parts[1]), `"`)
+	}
+
+	return values, scanner.Err()
+}
+
+// loadConfig builds a Config from args, the environment and an optional config file.
+// define may add command-specific flags to the set before parsing.
+// Flags may come before or after positional arguments, which are returned.
+func loadConfig(name string, args []string, define func(fs *flag.FlagSet)) (*Config, []string, error) {
+	config := defaultConfig()
+	fs := config.flagSet(name)
+
+	// only config flags, not command-specific ones, can come from the config file or environment
+	configFlags := make(map[string]bool)
+	fs.VisitAll(func(f *flag.Flag) {
+		configFlags[f.Name] = f.Name != "config"
+	})
+
+	if define != nil {
+		define(fs)
+	}
+
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	configPath := fs.Lookup("config").Value.String()
+	if configPath == "" {
+		configPath = os.Getenv(envName("config"))
+	}
+	if configPath != "" {
+		values, err := readConfigFile(configPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		for key, value := range values {
+			if !configFlags[key] {
+				return nil, nil, fmt.Errorf("%s: unknown setting %s", configPath, key)
+			}
+			if explicit[key] {
+				continue
+			}
+			if err := fs.Set(key, value); err != nil {
+				return nil, nil, fmt.Errorf("%s: %s: %v", configPath, key, err)
+			}
+		}
+	}
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if envErr != nil || explicit[f.Name] || !configFlags[f.Name] {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				envErr = fmt.Errorf("%s: %v", envName(f.Name), err)
+			}
+		}
+	})
+	if envErr != nil {
+		return nil, nil, envErr
+	}
+
+	if config.AdminUsersFile == "" {
+		config.AdminUsersFile = path.Join(config.StateDirectory, "admin-users")
+	}
+	if config.APITokensFile == "" {
+		config.APITokensFile = path.Join(config.StateDirectory, "api-tokens")
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return config, positional, nil
+}
+
+// parseInterspersed parses flags that may be mixed in between positional arguments,
+// like "share create some/path -public". A "--" stops flag parsing.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		if args[0] == "--" {
+			return append(positional, args[1:]...), nil
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// Validate reports the first setting that would stop the server from working.
+func (config *Config) Validate() error {
+	stat, err := os.Stat(config.DataDirectory)
+	if err != nil {
+		return fmt.Errorf("data directory: %v", err)
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("data directory %s is not a directory", config.DataDirectory)
+	}
+
+	for name, baseURL := range map[string]*string{"base URL": &config.BaseURL, "public base URL": &config.PublicBaseURL} {
+		if *baseURL == "" {
+			continue
+		}
+		parsed, err := url.Parse(*baseURL)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("%s must look like https://example.com", name)
+		}
+		if strings.Trim(parsed.Path, "/") != "" || parsed.RawQuery != "" || parsed.Fragment != "" {
+			return fmt.Errorf("%s must not have a path, use the path prefix instead", name)
+		}
+		*baseURL = parsed.Scheme + "://" + parsed.Host
+	}
+
+	if config.PathPrefix != "" {
+		if !strings.HasPrefix(config.PathPrefix, "/") {
+			return errors.New("path prefix must start with /")
+		}
+		config.PathPrefix = strings.TrimSuffix(path.Clean(config.PathPrefix), "/")
+	}
+
+	if config.Symlinks != safefs.SymlinksFollow && config.Symlinks != safefs.SymlinksDeny {
+		return fmt.Errorf("symlinks must be %s or %s", safefs.SymlinksFollow, safefs.SymlinksDeny)
+	}
+	for _, glob := range config.IgnoreGlobs() {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("ignore glob %q: %v", glob, err)
+		}
+	}
+
+	if config.StateDirectory == "" {
+		return errors.New("state directory must be set")
+	}
+
+	if _, _, err := net.SplitHostPort(config.ListenAddress); err != nil {
+		return fmt.Errorf("listen address: %v", err)
+	}
+
+	proxies, err := config.TrustedProxyNetworks()
+	if err != nil {
+		return fmt.Errorf("trusted proxies: %v", err)
+	}
+
+	if config.ChallengeIDLength < 8 {
+		return errors.New("challenge ID length must be at least 8")
+	}
+	if config.ChallengeRandomPasswordLength < 1 {
+		return errors.New("challenge random password length must be positive")
+	}
+
+	if config.SessionLifetime <= 0 {
+		return errors.New("session lifetime must be positive")
+	}
+
+	if config.UnlockMaxAttempts < 0 || config.UnlockMaxChallengeAttempts < 0 {
+		return errors.New("unlock max attempts must not be negative")
+	}
+	if config.UnlockLockout <= 0 || config.UnlockMaxLockout < config.UnlockLockout {
+		return errors.New("unlock lockout must be positive and no longer than unlock max lockout")
+	}
+
+	switch config.AdminAuth {
+	case adminAuthUsers, adminAuthNone:
+	case adminAuthProxy:
+		if config.AdminProxyHeader == "" {
+			return errors.New("admin proxy header must be set when admin auth is proxy")
+		}
+		if len(proxies) == 0 {
+			return errors.New("trusted proxies must be set when admin auth is proxy")
+		}
+	default:
+		return fmt.Errorf("admin auth must be %s, %s or %s", adminAuthUsers, adminAuthProxy, adminAuthNone)
+	}
+	if config.AdminSessionLifetime <= 0 {
+		return errors.New("admin session lifetime must be positive")
+	}
+
+	if config.ThumbnailSize < 16 || config.ThumbnailSize > 2048 {
+		return errors.New("thumbnail size must be between 16 and 2048")
+	}
+
+	if !isChallengeIDStyle(config.DefaultIDStyle) {
+		return fmt.Errorf("default %v", errChallengeIDStyle)
+	}
+	if config.DefaultExpiresAfter < 0 {
+		return errors.New("default expires after must not be negative")
+	}
+	if config.DefaultMaxViewCount < 0 {
+		return errors.New("default max view count must not be negative")
+	}
+
+	if config.JanitorInterval < 0 || config.JanitorRetention < 0 {
+		return errors.New("janitor interval and retention must not be negative")
+	}
+	if config.JanitorAction != janitorActionArchive && config.JanitorAction != janitorActionDelete {
+		return fmt.Errorf("janitor action must be %s or %s", janitorActionArchive, janitorActionDelete)
+	}
+
+	return nil
+}
+
+func (config *Config) LogSummary() {
+	log.Printf("Serving files from %s", config.DataDirectory)
+	log.Printf("Saving state to %s", config.StateDirectory)
+	log.Printf("Listening on %s", config.ListenAddress)
+	if config.BaseURL != "" || config.PublicBaseURL != "" || config.PathPrefix != "" {
+		log.Printf("Links: base URL %q, public base URL %q, path prefix %q", config.BaseURL, config.PublicBaseURL, config.PathPrefix)
+	}
+	if proxies, _ := config.TrustedProxyNetworks(); len(proxies) > 0 {
+		log.Printf("Trusting X-Forwarded-For from %v", proxies)
+	}
+	log.Printf("Symlinks: %s, hide dotfiles: %v, ignore: %v", config.Symlinks, config.HideDotfiles, config.IgnoreGlobs())
+	log.Printf("Admin auth: %s", config.AdminAuth)
+	if config.UnlockMaxAttempts > 0 || config.UnlockMaxChallengeAttempts > 0 {
+		log.Printf("Unlock lockout: after %d wrong passwords per IP or %d per share, for %v up to %v", config.UnlockMaxAttempts, config.UnlockMaxChallengeAttempts, config.UnlockLockout, config.UnlockMaxLockout)
+	}
+	log.Printf("Share defaults: id-style=%s public=%v expires-after=%v max-view-count=%d", config.DefaultIDStyle, config.DefaultPublic, config.DefaultExpiresAfter, config.DefaultMaxViewCount)
+	if config.JanitorInterval > 0 {
+		log.Printf("Janitor: %s shares dead for %v, every %v", config.JanitorAction, config.JanitorRetention, config.JanitorInterval)
+	}
+	if config.LoadDemoFixtures {
+		log.Printf("Loading demo fixtures")
+	}
+}
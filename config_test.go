@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfigFile(t *testing.T, contents string) string {
+	filePath := filepath.Join(t.TempDir(), "creamy.conf")
+	if err := os.WriteFile(filePath, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dataDirectory := t.TempDir()
+
+	cases := []struct {
+		name     string
+		file     string
+		env      string
+		flag     string
+		expected string
+	}{
+		{"default", "", "", "", ":8080"},
+		{"file", ":1111", "", "", ":1111"},
+		{"env", "", ":2222", "", ":2222"},
+		{"flag", "", "", ":3333", ":3333"},
+		{"env over file", ":1111", ":2222", "", ":2222"},
+		{"flag over file", ":1111", "", ":3333", ":3333"},
+		{"flag over env", "", ":2222", ":3333", ":3333"},
+		{"flag over everything", ":1111", ":2222", ":3333", ":3333"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("CREAMY_DATA_DIRECTORY", dataDirectory)
+			args := []string{}
+			if c.file != "" {
+				args = append(args, "-config", writeTestConfigFile(t, "# comment\nlisten-address = \""+c.file+"\"\n"))
+			}
+			if c.env != "" {
+				t.Setenv("CREAMY_LISTEN_ADDRESS", c.env)
+			}
+			if c.flag != "" {
+				args = append(args, "-listen-address", c.flag)
+			}
+
+			config, _, err := loadConfig("test", args, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ListenAddress != c.expected {
+				t.Errorf("expected listen address %q but got %q", c.expected, config.ListenAddress)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dataDirectory := t.TempDir()
+	t.Setenv("CREAMY_CONFIG", writeTestConfigFile(t, "data-directory = "+dataDirectory+"\nthumbnail-size = 128\n"))
+	t.Setenv("CREAMY_SESSION_LIFETIME", "5m")
+	t.Setenv("CREAMY_PUBLIC", "true")
+
+	var public bool
+	config, positional, err := loadConfig("test", []string{"some/path", "-public", "-state-directory", "elsewhere", "other/path"}, func(fs *flag.FlagSet) {
+		fs.BoolVar(&public, "public", false, "")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.DataDirectory != dataDirectory || config.ThumbnailSize != 128 || config.SessionLifetime != 5*time.Minute {
+		t.Errorf("expected settings from the environment's config file and environment but got %+v", config)
+	}
+	if config.AdminUsersFile != "elsewhere/admin-users" || config.APITokensFile != "elsewhere/api-tokens" {
+		t.Errorf("expected files in the state directory but got %q and %q", config.AdminUsersFile, config.APITokensFile)
+	}
+	if !public || strings.Join(positional, " ") != "some/path other/path" {
+		t.Errorf("expected -public and two paths but got %v and %v", public, positional)
+	}
+
+	public = false
+	if _, _, err := loadConfig("test", nil, func(fs *flag.FlagSet) {
+		fs.BoolVar(&public, "public", false, "")
+	}); err != nil || public {
+		t.Errorf("expected command-specific flags not to come from the environment but got %v, %v", public, err)
+	}
+
+	errorCases := map[string]string{
+		"unknown setting":         "colour = blue\n",
+		"command-specific flag":   "public = true\n",
+		"bad value":               "thumbnail-size = big\n",
+		"missing equals":          "thumbnail-size\n",
+		"invalid after resolving": "thumbnail-size = 4\n",
+	}
+	for name, contents := range errorCases {
+		_, _, err := loadConfig("test", []string{"-config", writeTestConfigFile(t, contents)}, func(fs *flag.FlagSet) {
+			fs.Bool("public", false, "")
+		})
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	t.Setenv("CREAMY_THUMBNAIL_SIZE", "big")
+	if _, _, err := loadConfig("test", nil, nil); err == nil || !strings.Contains(err.Error(), "CREAMY_THUMBNAIL_SIZE") {
+		t.Errorf("expected an error naming CREAMY_THUMBNAIL_SIZE but got %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	dataDirectory := t.TempDir()
+	notDirectory := filepath.Join(dataDirectory, "file")
+	if err := os.WriteFile(notDirectory, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		change   func(config *Config)
+		expected string
+	}{
+		{"valid", func(config *Config) {}, ""},
+		{"missing data directory", func(config *Config) { config.DataDirectory = filepath.Join(dataDirectory, "missing") }, "data directory"},
+		{"data directory is a file", func(config *Config) { config.DataDirectory = notDirectory }, "is not a directory"},
+		{"base URL without scheme", func(config *Config) { config.BaseURL = "example.com" }, "base URL must look like"},
+		{"base URL with path", func(config *Config) { config.BaseURL = "https://example.com/stuff" }, "use the path prefix"},
+		{"relative path prefix", func(config *Config) { config.PathPrefix = "stuff" }, "path prefix must start with /"},
+		{"unknown symlinks", func(config *Config) { config.Symlinks = "maybe" }, "symlinks must be"},
+		{"bad ignore glob", func(config *Config) { config.Ignore = "[" }, "ignore glob"},
+		{"no state directory", func(config *Config) { config.StateDirectory = "" }, "state directory must be set"},
+		{"listen address without port", func(config *Config) { config.ListenAddress = "localhost" }, "listen address"},
+		{"bad trusted proxies", func(config *Config) { config.TrustedProxies = "not a network" }, "trusted proxies"},
+		{"one bad trusted proxy", func(config *Config) { config.TrustedProxies = "10.0.0.0/8, 172.16.0.0/33" }, "trusted proxies"},
+		{"proxy auth with blank trusted proxies", func(config *Config) {
+			config.AdminAuth = adminAuthProxy
+			config.TrustedProxies = " , "
+		}, "trusted proxies must be set"},
+		{"short IDs", func(config *Config) { config.ChallengeIDLength = 4 }, "challenge ID length"},
+		{"lockout longer than max", func(config *Config) { config.UnlockMaxLockout = time.Second }, "unlock lockout"},
+		{"unknown admin auth", func(config *Config) { config.AdminAuth = "magic" }, "admin auth must be"},
+		{"proxy auth without header", func(config *Config) {
+			config.AdminAuth = adminAuthProxy
+			config.AdminProxyHeader = ""
+			config.TrustedProxies = "10.0.0.0/8"
+		}, "admin proxy header must be set"},
+		{"proxy auth without trusted proxies", func(config *Config) { config.AdminAuth = adminAuthProxy }, "trusted proxies must be set"},
+		{"proxy auth with trusted proxies", func(config *Config) {
+			config.AdminAuth = adminAuthProxy
+			config.TrustedProxies = "10.0.0.0/8"
+		}, ""},
+		{"tiny thumbnails", func(config *Config) { config.ThumbnailSize = 8 }, "thumbnail size"},
+		{"unknown ID style", func(config *Config) { config.DefaultIDStyle = "fancy" }, "default"},
+		{"negative default expiry", func(config *Config) { config.DefaultExpiresAfter = -time.Hour }, "default expires after"},
+		{"unknown janitor action", func(config *Config) { config.JanitorAction = "shred" }, "janitor action must be"},
+	}
+	for _, c := range cases {
+		config := defaultConfig()
+		config.DataDirectory = dataDirectory
+		c.change(config)
+
+		err := config.Validate()
+		if c.expected == "" && err != nil {
+			t.Errorf("%s: expected no error but got %v", c.name, err)
+		}
+		if c.expected != "" && (err == nil || !strings.Contains(err.Error(), c.expected)) {
+			t.Errorf("%s: expected an error containing %q but got %v", c.name, c.expected, err)
+		}
+	}
+
+	config := defaultConfig()
+	config.TrustedProxies = "10.0.0.0/8 172.16.0.0/12,\t192.168.1.1"
+	proxies, err := config.TrustedProxyNetworks()
+	if err != nil || len(proxies) != 3 || !networksContain(proxies, "172.16.5.5") || !networksContain(proxies, "192.168.1.1") {
+		t.Errorf("expected 3 trusted proxies separated by spaces and commas but got %v, %v", proxies, err)
+	}
+
+	config = defaultConfig()
+	config.DataDirectory = dataDirectory
+	config.BaseURL = "https://example.com/"
+	config.PathPrefix = "/stuff/"
+	if err := config.Validate(); err != nil || config.BaseURL != "https://example.com" || config.PathPrefix != "/stuff" {
+		t.Errorf("expected Validate to tidy the base URL and path prefix but got %q, %q, %v", config.BaseURL, config.PathPrefix, err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+)
+
+// loadDemoFixtures seeds a few example shares. Existing shares with the same
+// IDs are left alone so their view counts survive restarts.
+func loadDemoFixtures(repo stuff.ChallengeRepository) {
+	seed := func(challenge *stuff.Challenge) {
+		if repo.Get(challenge.ID) == nil {
+			repo.Set(challenge)
+		}
+	}
+
+	seed(&stuff.Challenge{
+		ID:         "foo",
+		Public:     true,
+		SharedPath: "data",
+	})
+
+	barChallenge := &stuff.Challenge{
+		ID:         "bar",
+		Public:     false,
+		SharedPath: "data-private",
+	}
+	barChallenge.SetPassword("foo")
+	seed(barChallenge)
+
+	foobarChallenge := &stuff.Challenge{
+		ID:         "foobar",
+		Public:     true,
+		SharedPath: "data",
+	}
+	foobarChallenge.SetExpirationDate(time.Now().Add(1 * time.Minute))
+	seed(foobarChallenge)
+
+	floofChallenge := &stuff.Challenge{
+		ID:         "floof",
+		Public:     true,
+		SharedPath: "data",
+	}
+	floofChallenge.SetMaxViewCount(2)
+	seed(floofChallenge)
+}
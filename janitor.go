@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+)
+
+const janitorActionArchive = "archive"
+const janitorActionDelete = "delete"
+
+// janitorPageSize is how many challenges are checked per repository call.
+const janitorPageSize = 100
+
+// sweepChallenges archives or deletes challenges that have been expired or
+// exhausted for longer than retention, returning how many it cleaned up.
+func sweepChallenges(repo stuff.ChallengeRepository, now time.Time, retention time.Duration, action string) int {
+	dead := func(challenge *stuff.Challenge) bool {
+		since, ok := challenge.DeadSince()
+		return ok && now.Sub(since) >= retention
+	}
+
+	// collect first, the repository can't be changed while paging through it
+	deadIDs := []string{}
+	for offset := 0; ; offset += janitorPageSize {
+		challenges := repo.All(janitorPageSize, offset)
+		for _, challenge := range challenges {
+			if !challenge.Archived && dead(challenge) {
+				deadIDs = append(deadIDs, challenge.ID)
+			}
+		}
+		if len(challenges) < janitorPageSize {
+			break
+		}
+	}
+
+	swept := 0
+	for _, challengeID := range deadIDs {
+		if action == janitorActionDelete {
+			// it may have been edited back to life since we looked
+			if challenge := repo.Get(challengeID); challenge != nil && dead(challenge) {
+				repo.Bury(challenge)
+				swept++
+			}
+			continue
+		}
+
+		_, err := repo.Update(challengeID, func(challenge *stuff.Challenge) error {
+			if !dead(challenge) {
+				return errChallengeRevived
+			}
+			challenge.Archived = true
+			return nil
+		})
+		if err == nil {
+			swept++
+		}
+	}
+
+	return swept
+}
+
+var errChallengeRevived = errors.New("challenge is no longer expired")
+
+// runJanitor sweeps dead challenges every interval until ctx is cancelled.
+func runJanitor(ctx context.Context, repo stuff.ChallengeRepository, interval time.Duration, retention time.Duration, action string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if swept := sweepChallenges(repo, time.Now(), retention, action); swept > 0 {
+			log.Printf("Janitor cleaned up %d expired shares (%s)", swept, action)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+)
+
+func TestSweepChallenges(t *testing.T) {
+	now := time.Now()
+	retention := 24 * time.Hour
+
+	for _, action := range []string{janitorActionArchive, janitorActionDelete} {
+		repo := stuff.NewArrayChallengeRepository()
+
+		longExpired := &stuff.Challenge{ID: "long-expired"}
+		longExpired.SetExpirationDate(now.Add(-2 * retention))
+		repo.Set(longExpired)
+
+		recentlyExpired := &stuff.Challenge{ID: "recently-expired"}
+		recentlyExpired.SetExpirationDate(now.Add(-time.Hour))
+		repo.Set(recentlyExpired)
+
+		repo.Set(&stuff.Challenge{ID: "alive", Public: true})
+
+		if swept := sweepChallenges(repo, now, retention, action); swept != 1 {
+			t.Errorf("%s: expected 1 challenge swept but got %d", action, swept)
+		}
+
+		switch action {
+		case janitorActionArchive:
+			if challenge := repo.Get("long-expired"); challenge == nil || !challenge.Archived {
+				t.Errorf("%s: expected long-expired to be archived", action)
+			}
+		case janitorActionDelete:
+			if repo.Get("long-expired") != nil || repo.Tombstone("long-expired") == nil {
+				t.Errorf("%s: expected long-expired to be replaced by a tombstone", action)
+			}
+		}
+
+		if challenge := repo.Get("recently-expired"); challenge == nil || challenge.Archived {
+			t.Errorf("%s: expected recently-expired to be kept until retention passes", action)
+		}
+		if swept := sweepChallenges(repo, now, retention, action); swept != 0 {
+			t.Errorf("%s: expected nothing left to sweep but got %d", action, swept)
+		}
+	}
+}
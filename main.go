@@ -4,64 +4,55 @@ package main
 //go:generate qtc -dir=templates
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"path"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/AlbinoDrought/creamy-stuff/safefs"
 	"github.com/AlbinoDrought/creamy-stuff/stuff"
 	"github.com/AlbinoDrought/creamy-stuff/templates"
+	"github.com/AlbinoDrought/creamy-stuff/thumbnails"
 	"github.com/julienschmidt/httprouter"
 )
 
-const challengeIDLength = 64
-const challengeRandomPasswordLength = 128
+var config = defaultConfig()
 
-var dataDirectory = "data"
+// shutdownTimeout is how long running downloads get to finish when stopping.
+const shutdownTimeout = 30 * time.Second
 
 var challengeRepository stuff.ChallengeRepository
+var sessionStore stuff.SessionStore
+var adminAuthenticator AdminAuthenticator
+var apiTokens []APIToken
+var thumbnailGenerator *thumbnails.Generator
+var dataFileSystem *safefs.FileSystem
+var unlockLimiter *stuff.UnlockLimiter
+var trustedProxies []*net.IPNet
 var challengeURLGenerator ChallengeURLGenerator
 var browseURLGenerator BrowseURLGenerator
+var adminURLGenerator AdminURLGenerator
 
 func init() {
-	challengeRepository = stuff.NewArrayChallengeRepository()
-
-	challengeRepository.Set(&stuff.Challenge{
-		ID:         "foo",
-		Public:     true,
-		SharedPath: "data",
-	})
-
-	barChallenge := &stuff.Challenge{
-		ID:         "bar",
-		Public:     false,
-		SharedPath: "data-private",
-	}
-	barChallenge.SetPassword("foo")
-	challengeRepository.Set(barChallenge)
-
-	foobarChallenge := &stuff.Challenge{
-		ID:         "foobar",
-		Public:     true,
-		SharedPath: "data",
-	}
-	foobarChallenge.SetExpirationDate(time.Now().Add(1 * time.Minute))
-	challengeRepository.Set(foobarChallenge)
-
-	floofChallenge := &stuff.Challenge{
-		ID:         "floof",
-		Public:     true,
-		SharedPath: "data",
-	}
-	floofChallenge.SetMaxViewCount(2)
-	challengeRepository.Set(floofChallenge)
-
 	urlGenerator := &hardcodedURLGenerator{}
 	challengeURLGenerator = urlGenerator
 	browseURLGenerator = urlGenerator
+	adminURLGenerator = urlGenerator
 }
 
 func writeErrorPage(w http.ResponseWriter, page *templates.ErrorPage) {
@@ -90,16 +81,195 @@ func renderChallengeNotFound(w http.ResponseWriter, r *http.Request, ID string)
 	})
 }
 
+// renderTooManyAttempts tells a visitor locked out of a challenge how long to wait.
+func renderTooManyAttempts(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeErrorPage(w, &templates.ErrorPage{
+		Status: http.StatusTooManyRequests,
+		Text:   fmt.Sprintf("Too many wrong passwords, try again in %v", time.Duration(seconds)*time.Second),
+	})
+}
+
+// clientIP is the address of whoever sent r, without the port. Behind trusted proxies,
+// it is the last address in X-Forwarded-For that isn't one of them, since earlier
+// entries can be made up by the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(header, ",") {
+			if ip = strings.TrimSpace(ip); net.ParseIP(ip) != nil {
+				forwarded = append(forwarded, ip)
+			}
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		host = forwarded[i]
+		if !isTrustedProxy(host) {
+			break
+		}
+	}
+	return host
+}
+
+func isTrustedProxy(ip string) bool {
+	return networksContain(trustedProxies, ip)
+}
+
+func networksContain(networks []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+type peerIPContextKey struct{}
+
+// withClientIP replaces RemoteAddr with the client's address from clientIP,
+// so view logs and network rules see visitors rather than the reverse proxy.
+// The address that actually connected is kept for peerIP.
+func withClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, port, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		r = r.WithContext(context.WithValue(r.Context(), peerIPContextKey{}, host))
+		if ip := clientIP(r); err == nil && ip != host {
+			r.RemoteAddr = net.JoinHostPort(ip, port)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// peerIP is the address that connected to us for r, which is the reverse proxy if there is one.
+func peerIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(peerIPContextKey{}).(string); ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// refuseChallengeNetwork renders a 403 and returns true if r comes from somewhere
+// challenge's network rules don't allow.
+func refuseChallengeNetwork(w http.ResponseWriter, r *http.Request, challenge *stuff.Challenge) bool {
+	ip := clientIP(r)
+	rule, allowed := challenge.NetworkRule(ip)
+	if allowed {
+		return false
+	}
+
+	log.Printf("Refused %v access to challenge %v: %s", ip, challenge.ID, rule)
+	writeErrorPage(w, &templates.ErrorPage{
+		Status: http.StatusForbidden,
+		Text:   "This link isn't available from your network",
+	})
+	return true
+}
+
+func renderFileNotFound(w http.ResponseWriter, r *http.Request) {
+	writeErrorPage(w, &templates.ErrorPage{
+		Status: http.StatusNotFound,
+		Text:   "File not found",
+	})
+}
+
+// renderOpenError explains why filePath couldn't be opened. Hidden files and
+// symlinks we refuse to follow look the same as missing ones.
+func renderOpenError(w http.ResponseWriter, r *http.Request, filePath string, err error) {
+	if errors.Is(err, safefs.ErrOutsideRoot) || errors.Is(err, safefs.ErrSymlink) {
+		log.Printf("Refused to open %v: %v", filePath, err)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		renderFileNotFound(w, r)
+		return
+	}
+
+	log.Printf("Error opening file %v: %v", filePath, err)
+	renderServerError(w, r, err)
+}
+
+const challengesDefaultLimit = 10
+const challengesMaxLimit = 100
+
+// renderChallengeGone tells visitors of a dead, revoked or cleaned up link that it expired.
+func renderChallengeGone(w http.ResponseWriter, r *http.Request) {
+	writeErrorPage(w, &templates.ErrorPage{
+		Status: http.StatusGone,
+		Text:   "This link has expired or was revoked",
+	})
+}
+
+// renderChallengeScheduled shows when a link that isn't valid yet opens, instead of a bare 401.
+func renderChallengeScheduled(w http.ResponseWriter, r *http.Request, challenge *stuff.Challenge) {
+	remaining := time.Until(challenge.ValidFrom)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+	w.WriteHeader(http.StatusForbidden)
+	templates.WritePageTemplate(w, &templates.ScheduledPage{
+		ValidFrom: challenge.ValidFrom,
+		Remaining: remaining,
+	}, &templates.EmptyNav{})
+}
+
+// renderMissingChallenge is renderChallengeNotFound for public routes,
+// which recognize links that were revoked or cleaned up by the janitor.
+func renderMissingChallenge(w http.ResponseWriter, r *http.Request, ID string) {
+	if challengeRepository.Tombstone(ID) != nil || challengeRepository.Tombstone(normalizeShortCode(ID)) != nil {
+		renderChallengeGone(w, r)
+		return
+	}
+	renderChallengeNotFound(w, r, ID)
+}
+
 func handleChallengesIndex(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	// todo: allow controlling pagination
-	challenges := challengeRepository.All(10, 0)
+	query := r.URL.Query()
+
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 || limit > challengesMaxLimit {
+		limit = challengesDefaultLimit
+	}
+
+	challengeQuery := stuff.ChallengeQuery{
+		Status:     query.Get("status"),
+		PathPrefix: query.Get("path"),
+		Search:     query.Get("q"),
+
+		Limit:  limit,
+		Offset: (page - 1) * limit,
+	}
+	challenges, total := challengeRepository.Query(challengeQuery)
 
 	challengeResources := make([]*templates.ChallengeResource, len(challenges))
 	for i, challenge := range challenges {
 		challengeResources[i] = &templates.ChallengeResource{
 			Challenge: challenge,
 
-			ViewLink: challengeURLGenerator.ViewChallenge(challenge),
+			ViewLink:   challengeURLGenerator.ViewChallenge(challenge),
+			EditLink:   adminURLGenerator.EditChallengePath(challenge),
+			ViewsLink:  adminURLGenerator.ChallengeViewsPath(challenge, ""),
+			DeleteLink: adminURLGenerator.DeleteChallengePath(challenge),
 		}
 	}
 
@@ -110,12 +280,32 @@ func handleChallengesIndex(w http.ResponseWriter, r *http.Request, ps httprouter
 		return
 	}
 
-	templates.WritePageTemplate(w, &templates.ChallengeIndexPage{
+	// page links keep the current filters
+	pageLink := func(page int) string {
+		query.Set("page", strconv.Itoa(page))
+		return adminURLGenerator.ChallengesPath() + "?" + query.Encode()
+	}
+
+	indexPage := &templates.ChallengeIndexPage{
 		Challenges: challengeResources,
 		CSRF:       csrfToken,
 
-		Page: 1,
-	}, &templates.PrivateNav{})
+		Statuses:   stuff.ChallengeStatuses,
+		Status:     challengeQuery.Status,
+		PathPrefix: challengeQuery.PathPrefix,
+		Search:     challengeQuery.Search,
+		Limit:      limit,
+
+		Page:  page,
+		Total: total,
+	}
+	if page > 1 {
+		indexPage.PreviousLink = pageLink(page - 1)
+	}
+	if page*limit < total {
+		indexPage.NextLink = pageLink(page + 1)
+	}
+	templates.WritePageTemplate(w, indexPage, privateNav(r))
 }
 
 func handleChallengeDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -133,20 +323,198 @@ func handleChallengeDelete(w http.ResponseWriter, r *http.Request, ps httprouter
 		return
 	}
 
-	challengeRepository.Remove(challenge)
-	http.Redirect(w, r, "/challenges", http.StatusFound)
+	challengeRepository.Bury(challenge)
+	http.Redirect(w, r, adminURLGenerator.ChallengesPath(), http.StatusFound)
+}
+
+func handleChallengeEditForm(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	challengeID := ps.ByName("challenge")
+
+	challenge := challengeRepository.Get(challengeID)
+	if challenge == nil {
+		renderChallengeNotFound(w, r, challengeID)
+		return
+	}
+
+	csrfToken, err := getOrCreateCSRF(w, r)
+	if err != nil {
+		log.Printf("Error with getOrCreateCSRF: %v", err)
+		renderServerError(w, r, err)
+		return
+	}
+
+	editPage := &templates.EditChallengePage{
+		Challenge:     challenge,
+		CSRF:          csrfToken,
+		ViewCountings: stuff.ViewCountings,
+
+		ViewLink:   challengeURLGenerator.ViewChallenge(challenge),
+		CancelLink: adminURLGenerator.ChallengesPath(),
+	}
+	if challenge.Expires {
+		editPage.ExpirationDate = challenge.ValidUntil.Format("2006-01-02")
+		editPage.ExpirationTime = challenge.ValidUntil.Format("15:04")
+	}
+	if challenge.MaxServedBytes > 0 {
+		editPage.MaxServedMegabytes = strconv.FormatInt(challenge.MaxServedBytes/1024/1024, 10)
+	}
+	if challenge.MaxBytesPerSecond > 0 {
+		editPage.MaxKilobytesPerSecond = strconv.FormatInt(challenge.MaxBytesPerSecond/1024, 10)
+	}
+	editPage.AllowedNetworks = strings.Join(challenge.AllowedNetworks, ", ")
+	editPage.DeniedNetworks = strings.Join(challenge.DeniedNetworks, ", ")
+	if challenge.HasValidFrom {
+		editPage.ValidFromDate = challenge.ValidFrom.Format("2006-01-02")
+		editPage.ValidFromTime = challenge.ValidFrom.Format("15:04")
+	}
+	templates.WritePageTemplate(w, editPage, privateNav(r))
+}
+
+func handleChallengeEdit(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	challengeID := ps.ByName("challenge")
+
+	if err := validCSRF(r, r.FormValue("_token")); err != nil {
+		log.Printf("Error validating CSRF token: %v", err)
+		renderServerError(w, r, err)
+		return
+	}
+
+	var expirationDate time.Time
+	if r.FormValue("expires") == "1" {
+		var err error
+		if expirationDate, err = parseFormExpiration(r); err != nil {
+			log.Printf("Error parsing expiration time: %v", err)
+			renderServerError(w, r, err)
+			return
+		}
+	}
+
+	var validFrom time.Time
+	if r.FormValue("valid-from-enabled") == "1" {
+		var err error
+		if validFrom, err = parseFormValidFrom(r); err != nil {
+			log.Printf("Error parsing valid from time: %v", err)
+			renderServerError(w, r, err)
+			return
+		}
+	}
+
+	viewCounting, err := parseFormViewCounting(r)
+	if err != nil {
+		writeErrorPage(w, &templates.ErrorPage{
+			Status: http.StatusBadRequest,
+			Text:   err.Error(),
+		})
+		return
+	}
+
+	maxServedBytes, maxBytesPerSecond, err := parseFormDownloadLimits(r)
+	if err != nil {
+		log.Printf("Error parsing download limits: %v", err)
+		renderServerError(w, r, err)
+		return
+	}
+
+	allowedNetworks, deniedNetworks, err := parseFormNetworks(r)
+	if err != nil {
+		renderInvalidNetworks(w, r, err)
+		return
+	}
+
+	maxViewCount := 0
+	if r.FormValue("max-view-count-enabled") == "1" {
+		var err error
+		if maxViewCount, err = strconv.Atoi(r.FormValue("max-view-count")); err != nil {
+			log.Printf("Error converting max view count %s to int: %v", r.FormValue("max-view-count"), err)
+			renderServerError(w, r, err)
+			return
+		}
+	}
+
+	// hash before locking the repository, bcrypt is slow
+	passwordHash := ""
+	if challengePassword := r.FormValue("challenge-password"); challengePassword != "" {
+		var err error
+		if passwordHash, err = stuff.HashPassword(challengePassword); err != nil {
+			log.Printf("Error setting challenge password: %v", err)
+			renderServerError(w, r, err)
+			return
+		}
+	}
+
+	_, err = challengeRepository.Update(challengeID, func(challenge *stuff.Challenge) error {
+		challenge.Note = r.FormValue("note")
+		challenge.Public = r.FormValue("public") == "1"
+		challenge.Disabled = r.FormValue("disabled") == "1"
+
+		if passwordHash != "" {
+			// a new hash also signs out everyone who unlocked the old password
+			challenge.SetPasswordHash(passwordHash)
+		} else if r.FormValue("remove-password") == "1" {
+			challenge.RemovePassword()
+		}
+		if r.FormValue("revoke-sessions") == "1" {
+			challenge.SessionVersion++
+		}
+
+		if expirationDate.IsZero() {
+			challenge.RemoveExpirationDate()
+		} else {
+			challenge.SetExpirationDate(expirationDate)
+		}
+		challenge.AllowedNetworks = allowedNetworks
+		challenge.DeniedNetworks = deniedNetworks
+
+		if validFrom.IsZero() {
+			challenge.RemoveValidFrom()
+		} else {
+			challenge.SetValidFrom(validFrom)
+		}
+
+		if maxViewCount > 0 {
+			challenge.SetMaxViewCount(maxViewCount)
+		} else {
+			challenge.RemoveMaxViewCount()
+		}
+		challenge.ViewLimitPerFile = r.FormValue("view-limit-per-file") == "1"
+		if r.FormValue("reset-view-count") == "1" {
+			challenge.ResetViewCount()
+		}
+		challenge.ViewCounting = viewCounting
+		challenge.MaxServedBytes = maxServedBytes
+		challenge.MaxBytesPerSecond = maxBytesPerSecond
+		if r.FormValue("reset-served-bytes") == "1" {
+			challenge.ServedBytes = 0
+		}
+		if _, dead := challenge.DeadSince(); !dead {
+			// bring it back into the shares list
+			challenge.Archived = false
+		}
+
+		return nil
+	})
+	if err == stuff.ErrChallengeNotFound {
+		renderChallengeNotFound(w, r, challengeID)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating challenge %v: %v", challengeID, err)
+		renderServerError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, adminURLGenerator.ChallengesPath(), http.StatusFound)
 }
 
 func handleStuffIndex(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	filePath := path.Clean(ps.ByName("filepath"))
 
-	dir := http.Dir(dataDirectory)
-	file, err := dir.Open(filePath)
+	file, err := dataFileSystem.Open(filePath)
 	if err != nil {
-		log.Printf("Error opening file %v: %v", filePath, err)
-		renderServerError(w, r, err)
+		renderOpenError(w, r, filePath, err)
 		return
 	}
+	defer file.Close()
 
 	stat, err := file.Stat()
 	if err != nil {
@@ -156,8 +524,31 @@ func handleStuffIndex(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 	}
 
 	if !stat.IsDir() {
-		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", stat.Name()))
-		http.ServeFile(w, r, path.Join(dataDirectory, filePath))
+		resolvedPath, err := dataFileSystem.Resolve(filePath)
+		if err != nil {
+			renderOpenError(w, r, filePath, err)
+			return
+		}
+
+		query := r.URL.Query()
+		if query.Get("raw") != "" || query.Get("download") != "" {
+			serveFile(w, r, resolvedPath, path.Base(filePath), query.Get("download") != "")
+			return
+		}
+
+		previewPage, err := buildPreviewPage(path.Base(filePath), resolvedPath, true, true)
+		if err != nil {
+			log.Printf("Error previewing file %v: %v", filePath, err)
+			renderServerError(w, r, err)
+			return
+		}
+		previewPage.RawLink = browseURLGenerator.RawPath(filePath)
+		previewPage.DownloadLink = browseURLGenerator.DownloadPath(filePath)
+		previewPage.BackLink = browseURLGenerator.BrowsePath(path.Join(filePath, ".."))
+		if thumbnailGenerator.Supported(filePath) {
+			previewPage.ThumbnailLink = browseURLGenerator.ThumbnailPath(filePath)
+		}
+		templates.WritePageTemplate(w, previewPage, privateNav(r))
 		return
 	}
 
@@ -169,6 +560,7 @@ func handleStuffIndex(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 	}
 	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name() < dirs[j].Name() })
 
+	grid := r.URL.Query().Get("view") == "grid"
 	files := make([]templates.File, len(dirs))
 	for i, dir := range dirs {
 		name := dir.Name()
@@ -181,6 +573,12 @@ func handleStuffIndex(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 		files[i].Label = name
 		files[i].BrowseLink = browseURLGenerator.BrowsePath(pathRelativeToDataDir)
 		files[i].ShareLink = browseURLGenerator.SharePath(pathRelativeToDataDir)
+		files[i].Path = pathRelativeToDataDir
+		if dir.IsDir() {
+			files[i].BrowseLink = withGridView(files[i].BrowseLink, grid)
+		} else if thumbnailGenerator.Supported(name) {
+			files[i].ThumbnailLink = browseURLGenerator.ThumbnailPath(pathRelativeToDataDir)
+		}
 	}
 
 	atRoot := filePath == "" || filePath == "/" || filePath == "."
@@ -194,18 +592,105 @@ func handleStuffIndex(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 		Files:         files,
 
 		CanTravelUpwards: !atRoot,
-		UpwardsLink:      browseURLGenerator.BrowsePath(path.Join(filePath, "..")),
+		UpwardsLink:      withGridView(browseURLGenerator.BrowsePath(path.Join(filePath, "..")), grid),
+
+		Grid:     grid,
+		ListLink: browseURLGenerator.BrowsePath(filePath),
+		GridLink: withGridView(browseURLGenerator.BrowsePath(filePath), true),
+
+		ShareSelectedLink: browseURLGenerator.SharePath(filePath),
+	}
+	templates.WritePageTemplate(w, browsePage, privateNav(r))
+}
+
+func handleStuffThumbnail(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	filePath := path.Clean(ps.ByName("filepath"))
+
+	resolvedPath, err := dataFileSystem.Resolve(filePath)
+	if err != nil {
+		renderOpenError(w, r, filePath, err)
+		return
+	}
+	serveThumbnail(w, r, resolvedPath)
+}
+
+func serveThumbnail(w http.ResponseWriter, r *http.Request, filePath string) {
+	thumbnailPath, err := thumbnailGenerator.Thumbnail(filePath)
+	if err == thumbnails.ErrUnsupported || os.IsNotExist(err) {
+		writeErrorPage(w, &templates.ErrorPage{
+			Status: http.StatusNotFound,
+			Text:   "No thumbnail available",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Error generating thumbnail of %v: %v", filePath, err)
+		renderServerError(w, r, err)
+		return
 	}
-	templates.WritePageTemplate(w, browsePage, &templates.PrivateNav{})
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, thumbnailPath)
+}
+
+// withGridView keeps the grid view turned on when following a link to another directory.
+func withGridView(link string, grid bool) string {
+	if !grid {
+		return link
+	}
+	return link + "?view=grid"
+}
+
+// openSelectedPaths checks that every path picked with "share selected" can be shared.
+func openSelectedPaths(w http.ResponseWriter, r *http.Request, sharedPaths []string) bool {
+	for _, sharedPath := range sharedPaths {
+		file, err := dataFileSystem.Open(sharedPath)
+		if err != nil {
+			renderOpenError(w, r, sharedPath, err)
+			return false
+		}
+		file.Close()
+	}
+	return true
+}
+
+func renderNothingSelected(w http.ResponseWriter, r *http.Request) {
+	writeErrorPage(w, &templates.ErrorPage{
+		Status: http.StatusBadRequest,
+		Text:   "Select at least one file to share",
+	})
 }
 
 func handleStuffShowForm(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	filePath := path.Clean(ps.ByName("filepath"))
 
-	dir := http.Dir(dataDirectory)
-	_, err := dir.Open(filePath)
+	var sharedPaths []string
+	if r.URL.Query().Get("share-selected") != "" {
+		sharedPaths = parseSharedPaths(r.URL.Query()["path"])
+		switch len(sharedPaths) {
+		case 0:
+			renderNothingSelected(w, r)
+			return
+		case 1:
+			http.Redirect(w, r, browseURLGenerator.SharePath(sharedPaths[0]), http.StatusFound)
+			return
+		}
+		if !openSelectedPaths(w, r, sharedPaths) {
+			return
+		}
+	}
+
+	file, err := dataFileSystem.Open(filePath)
+	if err != nil {
+		renderOpenError(w, r, filePath, err)
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
 	if err != nil {
-		log.Printf("Error opening file %v: %v", filePath, err)
+		log.Printf("Error stat'ing file %v: %v", filePath, err)
 		renderServerError(w, r, err)
 		return
 	}
@@ -217,7 +702,7 @@ func handleStuffShowForm(w http.ResponseWriter, r *http.Request, ps httprouter.P
 		return
 	}
 
-	randomPassword, err := RandomString(challengeRandomPasswordLength)
+	randomPassword, err := RandomString(config.ChallengeRandomPasswordLength)
 	if err != nil {
 		log.Printf("Error generating random challenge password: %v", err)
 		renderServerError(w, r, err)
@@ -226,42 +711,169 @@ func handleStuffShowForm(w http.ResponseWriter, r *http.Request, ps httprouter.P
 
 	sharePage := &templates.SharePage{
 		Path:           filePath,
+		Paths:          sharedPaths,
+		IsDirectory:    stat.IsDir() && len(sharedPaths) == 0,
 		CSRF:           csrfToken,
 		RandomPassword: randomPassword,
 
+		IDStyles:            challengeIDStyles,
+		DefaultIDStyle:      config.DefaultIDStyle,
+		DefaultPublic:       config.DefaultPublic,
+		DefaultMaxViewCount: config.DefaultMaxViewCount,
+		ViewCountings:       stuff.ViewCountings,
+
 		CancelLink: browseURLGenerator.BrowsePath(path.Join(filePath, "..")),
 	}
-	templates.WritePageTemplate(w, sharePage, &templates.PrivateNav{})
+	if len(sharedPaths) > 0 {
+		// selected from inside filePath, so cancelling goes back there
+		sharePage.Path = strings.Join(sharedPaths, ", ")
+		sharePage.CancelLink = browseURLGenerator.BrowsePath(filePath)
+	}
+	if config.DefaultExpiresAfter > 0 {
+		defaultExpiration := time.Now().Add(config.DefaultExpiresAfter)
+		sharePage.DefaultExpires = true
+		sharePage.DefaultExpirationDate = defaultExpiration.Format("2006-01-02")
+		sharePage.DefaultExpirationTime = defaultExpiration.Format("15:04")
+	}
+	templates.WritePageTemplate(w, sharePage, privateNav(r))
+}
+
+// parseFormExpiration reads the expiration-date and expiration-time fields,
+// filling in whichever is missing from the default expiry.
+func parseFormExpiration(r *http.Request) (time.Time, error) {
+	defaultExpiresAfter := config.DefaultExpiresAfter
+	if defaultExpiresAfter == 0 {
+		defaultExpiresAfter = 24 * time.Hour
+	}
+	defaultExpiration := time.Now().Add(defaultExpiresAfter)
+
+	expirationDate := r.FormValue("expiration-date")
+	if expirationDate == "" {
+		expirationDate = defaultExpiration.Format("2006-01-02")
+	}
+	expirationTime := r.FormValue("expiration-time")
+	if expirationTime == "" {
+		expirationTime = defaultExpiration.Format("15:04")
+	}
+
+	return time.Parse("2006-01-02 15:04", expirationDate+" "+expirationTime)
+}
+
+// parseFormNetworks reads the allowed-networks and denied-networks fields.
+func parseFormNetworks(r *http.Request) (allowed []string, denied []string, err error) {
+	if allowed, err = stuff.ParseNetworks(r.FormValue("allowed-networks")); err != nil {
+		return nil, nil, err
+	}
+	if denied, err = stuff.ParseNetworks(r.FormValue("denied-networks")); err != nil {
+		return nil, nil, err
+	}
+	return allowed, denied, nil
+}
+
+func renderInvalidNetworks(w http.ResponseWriter, r *http.Request, err error) {
+	writeErrorPage(w, &templates.ErrorPage{
+		Status: http.StatusBadRequest,
+		Text:   "Invalid network: " + err.Error(),
+	})
+}
+
+// parseFormDownloadLimits reads the max-served-megabytes and max-kilobytes-per-second
+// fields, which are empty for no limit.
+func parseFormDownloadLimits(r *http.Request) (maxServedBytes int64, maxBytesPerSecond int64, err error) {
+	if maxServedBytes, err = parseFormSize(r, "max-served-megabytes", 1024*1024); err != nil {
+		return 0, 0, err
+	}
+	if maxBytesPerSecond, err = parseFormSize(r, "max-kilobytes-per-second", 1024); err != nil {
+		return 0, 0, err
+	}
+	return maxServedBytes, maxBytesPerSecond, nil
+}
+
+// parseFormSize reads an optional whole number of units from field, in bytes.
+func parseFormSize(r *http.Request, field string, unit int64) (int64, error) {
+	value := r.FormValue(field)
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("converting %s %s to int: %v", field, value, err)
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("%s must not be negative", field)
+	}
+	return size * unit, nil
+}
+
+var errViewCounting = fmt.Errorf("view counting must be one of %s", strings.Join(stuff.ViewCountings, ", "))
+
+// parseFormViewCounting reads the view-counting field, leaving the default empty.
+func parseFormViewCounting(r *http.Request) (string, error) {
+	policy := r.FormValue("view-counting")
+	if policy == "" || policy == stuff.ViewCountingRequest {
+		return "", nil
+	}
+	if !stuff.IsViewCounting(policy) {
+		return "", errViewCounting
+	}
+	return policy, nil
+}
+
+// parseFormValidFrom reads the valid-from-date and valid-from-time fields,
+// opening at midnight if no time is given.
+func parseFormValidFrom(r *http.Request) (time.Time, error) {
+	validFromTime := r.FormValue("valid-from-time")
+	if validFromTime == "" {
+		validFromTime = "00:00"
+	}
+
+	return time.Parse("2006-01-02 15:04", r.FormValue("valid-from-date")+" "+validFromTime)
 }
 
 func handleStuffReceiveForm(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	filePath := path.Clean(ps.ByName("filepath"))
 
-	dir := http.Dir(dataDirectory)
-	_, err := dir.Open(filePath)
+	file, err := dataFileSystem.Open(filePath)
 	if err != nil {
-		log.Printf("Error opening file %v: %v", filePath, err)
-		renderServerError(w, r, err)
+		renderOpenError(w, r, filePath, err)
 		return
 	}
+	defer file.Close()
 
-	if err := validCSRF(r, r.FormValue("_token")); err != nil {
-		log.Printf("Error validating CSRF token: %v", err)
+	stat, err := file.Stat()
+	if err != nil {
+		log.Printf("Error stat'ing file %v: %v", filePath, err)
 		renderServerError(w, r, err)
 		return
 	}
 
-	challengeID, err := RandomString(challengeIDLength)
-	if err != nil {
-		log.Printf("Error generating challenge ID: %v", err)
+	if err := validCSRF(r, r.FormValue("_token")); err != nil {
+		log.Printf("Error validating CSRF token: %v", err)
 		renderServerError(w, r, err)
 		return
 	}
 
 	challenge := &stuff.Challenge{
-		ID:         challengeID,
 		Public:     r.FormValue("public") == "1",
 		SharedPath: filePath,
+		Note:       r.FormValue("note"),
+	}
+	_, selected := r.PostForm["path"]
+	if selected {
+		sharedPaths := parseSharedPaths(r.PostForm["path"])
+		if len(sharedPaths) == 0 {
+			renderNothingSelected(w, r)
+			return
+		}
+		if !openSelectedPaths(w, r, sharedPaths) {
+			return
+		}
+		if len(sharedPaths) == 1 {
+			challenge.SharedPath = sharedPaths[0]
+		} else {
+			challenge.SharedPath = ""
+			challenge.SharedPaths = sharedPaths
+		}
 	}
 	if challengePassword := r.FormValue("challenge-password"); challengePassword != "" {
 		if err = challenge.SetPassword(challengePassword); err != nil {
@@ -271,23 +883,38 @@ func handleStuffReceiveForm(w http.ResponseWriter, r *http.Request, ps httproute
 		}
 	}
 	if expires := r.FormValue("expires"); expires == "1" {
-		expirationDate := r.FormValue("expiration-date")
-		if expirationDate == "" {
-			expirationDate = time.Now().Add(24 * time.Hour).Format("2006-01-02")
-		}
-		expirationTime := r.FormValue("expiration-time")
-		if expirationTime == "" {
-			expirationTime = time.Now().Format("15:04")
-		}
-
-		parsedExpirationTime, err := time.Parse("2006-01-02 15:04", expirationDate+" "+expirationTime)
+		expirationDate, err := parseFormExpiration(r)
 		if err != nil {
 			log.Printf("Error parsing expiration time: %v", err)
 			renderServerError(w, r, err)
 			return
 		}
-
-		challenge.SetExpirationDate(parsedExpirationTime)
+		challenge.SetExpirationDate(expirationDate)
+	}
+	if challenge.AllowedNetworks, challenge.DeniedNetworks, err = parseFormNetworks(r); err != nil {
+		renderInvalidNetworks(w, r, err)
+		return
+	}
+	if r.FormValue("valid-from-enabled") == "1" {
+		validFrom, err := parseFormValidFrom(r)
+		if err != nil {
+			log.Printf("Error parsing valid from time: %v", err)
+			renderServerError(w, r, err)
+			return
+		}
+		challenge.SetValidFrom(validFrom)
+	}
+	if challenge.MaxServedBytes, challenge.MaxBytesPerSecond, err = parseFormDownloadLimits(r); err != nil {
+		log.Printf("Error parsing download limits: %v", err)
+		renderServerError(w, r, err)
+		return
+	}
+	if challenge.ViewCounting, err = parseFormViewCounting(r); err != nil {
+		writeErrorPage(w, &templates.ErrorPage{
+			Status: http.StatusBadRequest,
+			Text:   err.Error(),
+		})
+		return
 	}
 	if maxViewCountEnabled := r.FormValue("max-view-count-enabled"); maxViewCountEnabled == "1" {
 		maxViewCount, err := strconv.Atoi(r.FormValue("max-view-count"))
@@ -297,29 +924,116 @@ func handleStuffReceiveForm(w http.ResponseWriter, r *http.Request, ps httproute
 			return
 		}
 		challenge.SetMaxViewCount(maxViewCount)
+		challenge.ViewLimitPerFile = r.FormValue("view-limit-per-file") == "1"
+	}
+	if acceptsUploads := r.FormValue("accepts-uploads"); acceptsUploads == "1" {
+		if selected {
+			err := fmt.Errorf("can't accept uploads into selected paths")
+			log.Printf("Error creating file request: %v", err)
+			renderServerError(w, r, err)
+			return
+		}
+		if !stat.IsDir() {
+			err := fmt.Errorf("can't accept uploads into %v, it isn't a directory", filePath)
+			log.Printf("Error creating file request: %v", err)
+			renderServerError(w, r, err)
+			return
+		}
+		challenge.AcceptsUploads = true
+
+		if value := r.FormValue("max-upload-megabytes"); value != "" {
+			maxUploadMegabytes, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				log.Printf("Error converting max upload size %s to int: %v", value, err)
+				renderServerError(w, r, err)
+				return
+			}
+			challenge.MaxUploadBytes = maxUploadMegabytes * 1024 * 1024
+		}
+		if value := r.FormValue("max-upload-files"); value != "" {
+			maxUploadFiles, err := strconv.Atoi(value)
+			if err != nil {
+				log.Printf("Error converting max upload files %s to int: %v", value, err)
+				renderServerError(w, r, err)
+				return
+			}
+			challenge.MaxUploadFiles = maxUploadFiles
+		}
+		challenge.AllowedExtensions = parseExtensions([]string{r.FormValue("allowed-extensions")})
 	}
 
-	challengeRepository.Set(challenge)
+	err = createChallenge(challengeRepository, config, challenge, r.FormValue("id-style"), r.FormValue("custom-id"))
+	switch err {
+	case nil:
+	case errChallengeIDStyle, errChallengeSlug:
+		writeErrorPage(w, &templates.ErrorPage{
+			Status: http.StatusBadRequest,
+			Text:   err.Error(),
+		})
+		return
+	case stuff.ErrChallengeIDTaken:
+		writeErrorPage(w, &templates.ErrorPage{
+			Status: http.StatusConflict,
+			Text:   "That ID is already taken",
+		})
+		return
+	default:
+		log.Printf("Error creating challenge: %v", err)
+		renderServerError(w, r, err)
+		return
+	}
 
 	sharedChallengePage := &templates.SharedChallengePage{
 		Challenge: challenge,
 
 		ViewLink: challengeURLGenerator.ViewChallenge(challenge),
 	}
-	templates.WritePageTemplate(w, sharedChallengePage, &templates.PrivateNav{})
+	templates.WritePageTemplate(w, sharedChallengePage, privateNav(r))
 }
 
 func handleChallengeFilepath(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	challengeID := ps.ByName("challenge")
 	filePath := path.Clean(ps.ByName("filepath"))
 
-	challenge := challengeRepository.Get(challengeID)
+	challenge := findChallenge(challengeRepository, challengeID)
 	if challenge == nil {
-		renderChallengeNotFound(w, r, challengeID)
+		renderMissingChallenge(w, r, challengeID)
+		return
+	}
+	if challenge.ID != challengeID {
+		// a short code typed loosely, send the visitor to where its links work
+		target := challengeURLGenerator.ViewChallengePath(challenge, filePath)
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+
+	// refused networks don't get to learn anything about the link, not even that it's dead
+	if refuseChallengeNetwork(w, r, challenge) {
+		return
+	}
+
+	if challenge.Disabled {
+		writeErrorPage(w, &templates.ErrorPage{
+			Status: http.StatusForbidden,
+			Text:   "This link has been disabled",
+		})
 		return
 	}
 
-	if !challenge.Accessible(r) {
+	if _, dead := challenge.DeadSince(); dead && !challenge.ContinuesView(r) {
+		renderChallengeGone(w, r)
+		return
+	}
+
+	if challenge.NotYetValid() {
+		renderChallengeScheduled(w, r, challenge)
+		return
+	}
+
+	if !challenge.Accessible(r, sessionStore) {
 		if challenge.HasPassword {
 			csrfToken, err := getOrCreateCSRF(w, r)
 			if err != nil {
@@ -340,15 +1054,36 @@ func handleChallengeFilepath(w http.ResponseWriter, r *http.Request, ps httprout
 		return
 	}
 
-	challengeBasePath := path.Join(dataDirectory, path.Clean(challenge.SharedPath))
-	dir := http.Dir(challengeBasePath)
-	file, err := dir.Open(filePath)
+	if challenge.AcceptsUploads {
+		// file requests only show the upload form, never what's already in the folder
+		writeUploadPage(w, r, challenge, nil, nil)
+		return
+	}
+
+	if len(challenge.SharedPaths) > 0 && isChallengeRoot(filePath) {
+		// several shared paths are listed side by side, in a folder that only exists here
+		if format := r.URL.Query().Get("archive"); format != "" {
+			handleChallengeArchive(w, r, challenge, filePath, format)
+			return
+		}
+		writeChallengeListing(w, r, challenge, filePath, challengeRootEntries(challenge))
+		return
+	}
+
+	// rooting the challenge at its shared path stops symlinks from leading out of the share
+	challengeFileSystem, sharedName, err := resolveChallengePath(challenge, filePath)
 	if err != nil {
-		log.Printf("Error opening file %v: %v", filePath, err)
-		renderServerError(w, r, err)
+		renderOpenError(w, r, filePath, err)
 		return
 	}
 
+	file, err := challengeFileSystem.Open(sharedName)
+	if err != nil {
+		renderOpenError(w, r, filePath, err)
+		return
+	}
+	defer file.Close()
+
 	stat, err := file.Stat()
 	if err != nil {
 		log.Printf("Error stat'ing file %v: %v", filePath, err)
@@ -356,16 +1091,41 @@ func handleChallengeFilepath(w http.ResponseWriter, r *http.Request, ps httprout
 		return
 	}
 
+	var resolvedPath string
 	if !stat.IsDir() {
-		challengeRepository.ReportChallengeView(challenge, filePath, r)
-		if challenge.HasViewCountLimit {
-			// some types of files can trigger many requests when displayed inline (streaming media).
-			// when a view count limit is enabled, serve the file as an attachment to bypass this.
-			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", stat.Name()))
-		} else {
-			w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", stat.Name()))
+		resolvedPath, err = challengeFileSystem.Resolve(sharedName)
+		if err != nil {
+			renderOpenError(w, r, filePath, err)
+			return
+		}
+	}
+
+	if !stat.IsDir() && r.URL.Query().Get("thumbnail") != "" {
+		// thumbnails are small previews, so they don't count as views
+		serveThumbnail(w, r, resolvedPath)
+		return
+	}
+
+	if !stat.IsDir() {
+		name := challengeFileName(challenge, filePath)
+		query := r.URL.Query()
+		if query.Get("raw") == "" && query.Get("download") == "" {
+			// the preview page itself is free, only loading the file counts as a view
+			handleChallengePreview(w, r, challenge, resolvedPath, filePath, name)
+			return
 		}
-		http.ServeFile(w, r, path.Join(challengeBasePath, filePath))
+
+		// streaming media inline makes many requests. when every one of them would use up
+		// one of a limited number of views, serve the file as an attachment instead.
+		attachment := query.Get("download") != "" || (challenge.HasViewCountLimit && challenge.CountsRepeats())
+		serveChallengeView(w, r, challenge, filePath, func(w http.ResponseWriter) {
+			serveFile(w, r, resolvedPath, name, attachment)
+		})
+		return
+	}
+
+	if format := r.URL.Query().Get("archive"); format != "" {
+		handleChallengeArchive(w, r, challenge, filePath, format)
 		return
 	}
 
@@ -377,6 +1137,11 @@ func handleChallengeFilepath(w http.ResponseWriter, r *http.Request, ps httprout
 	}
 	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name() < dirs[j].Name() })
 
+	writeChallengeListing(w, r, challenge, filePath, dirs)
+}
+
+func writeChallengeListing(w http.ResponseWriter, r *http.Request, challenge *stuff.Challenge, filePath string, dirs []os.FileInfo) {
+	grid := r.URL.Query().Get("view") == "grid"
 	files := make([]templates.File, len(dirs))
 	for i, dir := range dirs {
 		name := dir.Name()
@@ -386,9 +1151,18 @@ func handleChallengeFilepath(w http.ResponseWriter, r *http.Request, ps httprout
 
 		files[i].Label = name
 		files[i].BrowseLink = challengeURLGenerator.ViewChallengePath(challenge, path.Join(filePath, name))
+		if dir.IsDir() {
+			files[i].BrowseLink = withGridView(files[i].BrowseLink, grid)
+		} else if thumbnailGenerator.Supported(name) {
+			files[i].ThumbnailLink = challengeURLGenerator.ViewChallengeThumbnail(challenge, path.Join(filePath, name))
+		}
+		if challenge.HasViewCountLimit && challenge.ViewLimitPerFile && !dir.IsDir() {
+			files[i].HasRemainingViews = true
+			files[i].RemainingViews = challenge.RemainingViews(path.Join(filePath, name))
+		}
 	}
 
-	atRoot := filePath == "" || filePath == "/" || filePath == "."
+	atRoot := isChallengeRoot(filePath)
 	directoryName := filePath
 	if atRoot {
 		directoryName = "/"
@@ -399,23 +1173,131 @@ func handleChallengeFilepath(w http.ResponseWriter, r *http.Request, ps httprout
 		Files:         files,
 
 		CanTravelUpwards: !atRoot,
-		UpwardsLink:      challengeURLGenerator.ViewChallengePath(challenge, path.Join(filePath, "..")),
+		UpwardsLink:      withGridView(challengeURLGenerator.ViewChallengePath(challenge, path.Join(filePath, "..")), grid),
+
+		Grid:     grid,
+		ListLink: challengeURLGenerator.ViewChallengePath(challenge, filePath),
+		GridLink: withGridView(challengeURLGenerator.ViewChallengePath(challenge, filePath), true),
+
+		ZipLink:   challengeURLGenerator.DownloadChallengeArchive(challenge, filePath, archiveFormatZip),
+		TarGzLink: challengeURLGenerator.DownloadChallengeArchive(challenge, filePath, archiveFormatTarGz),
+	}
+	if challenge.HasViewCountLimit && challenge.ViewLimitPerFile {
+		// see handleChallengeArchive
+		browsePage.ZipLink = ""
+		browsePage.TarGzLink = ""
 	}
 	templates.WritePageTemplate(w, browsePage, &templates.EmptyNav{})
 }
 
+func handleChallengePreview(w http.ResponseWriter, r *http.Request, challenge *stuff.Challenge, resolvedPath string, filePath string, name string) {
+	// embedding the file would load it over and over, using up views each time, so
+	// limited challenges that count every request only get a thumbnail.
+	// Text read into the page isn't counted or throttled, so it is only inlined without limits.
+	inlineText := !challenge.HasViewCountLimit && challenge.MaxServedBytes == 0 && challenge.MaxBytesPerSecond == 0
+	previewPage, err := buildPreviewPage(name, resolvedPath, !challenge.HasViewCountLimit || !challenge.CountsRepeats(), inlineText)
+	if err != nil {
+		log.Printf("Error previewing file %v for challenge %v: %v", filePath, challenge.ID, err)
+		renderServerError(w, r, err)
+		return
+	}
+	if remainingViews := challenge.RemainingViews(filePath); remainingViews >= 0 {
+		viewsOf := "this link's"
+		if challenge.ViewLimitPerFile {
+			viewsOf = "this file's"
+		}
+		previewPage.Message = fmt.Sprintf("%s uses one of %s %d remaining views.", viewCountingAction(challenge), viewsOf, remainingViews)
+	}
+
+	previewPage.RawLink = challengeURLGenerator.ViewChallengeRaw(challenge, filePath)
+	previewPage.DownloadLink = challengeURLGenerator.DownloadChallengeFile(challenge, filePath)
+	if !isChallengeRoot(filePath) {
+		previewPage.BackLink = challengeURLGenerator.ViewChallengePath(challenge, path.Join(filePath, ".."))
+	}
+	if thumbnailGenerator.Supported(name) {
+		previewPage.ThumbnailLink = challengeURLGenerator.ViewChallengeThumbnail(challenge, filePath)
+	}
+	templates.WritePageTemplate(w, previewPage, &templates.EmptyNav{})
+}
+
+// viewCountingAction describes what uses up a view under challenge's view counting policy.
+func viewCountingAction(challenge *stuff.Challenge) string {
+	switch challenge.ViewCountingPolicy() {
+	case stuff.ViewCountingFile:
+		return "Opening or downloading this file for the first time"
+	case stuff.ViewCountingDownload:
+		return "Loading this whole file for the first time"
+	}
+	return "Opening or downloading this file"
+}
+
+// handleChallengeArchive streams a shared directory as a single download,
+// which counts as one view.
+func handleChallengeArchive(w http.ResponseWriter, r *http.Request, challenge *stuff.Challenge, filePath string, format string) {
+	contentType, supported := archiveContentTypes[format]
+	if !supported {
+		writeErrorPage(w, &templates.ErrorPage{
+			Status: http.StatusBadRequest,
+			Text:   "Unsupported archive format",
+		})
+		return
+	}
+
+	if challenge.HasViewCountLimit && challenge.ViewLimitPerFile {
+		// a view of the whole folder would get around the limits of the files in it
+		writeErrorPage(w, &templates.ErrorPage{
+			Status: http.StatusForbidden,
+			Text:   "This link limits downloads of each file, so files must be downloaded one at a time",
+		})
+		return
+	}
+
+	sources, err := challengeArchiveSources(challenge, filePath)
+	if err != nil {
+		renderOpenError(w, r, filePath, err)
+		return
+	}
+
+	archiveName := challengeFileName(challenge, filePath)
+	if archiveName == "/" || archiveName == "." {
+		archiveName = "download"
+	}
+	for i := range sources {
+		// every entry goes under a top-level folder named after the download
+		sources[i].prefix = path.Join(archiveName, sources[i].prefix)
+	}
+
+	serveChallengeView(w, r, challenge, filePath, func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", archiveName, format))
+		if err := writeArchive(w, format, sources); err != nil {
+			// the response has already started, so all we can do is log and cut it short
+			log.Printf("Error writing %v archive of %v for challenge %v: %v", format, filePath, challenge.ID, err)
+		}
+	})
+}
+
 func handleChallengeAuthentication(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	challengeID := ps.ByName("challenge")
 	filePath := ps.ByName("filepath")
 
-	challenge := challengeRepository.Get(challengeID)
+	challenge := findChallenge(challengeRepository, challengeID)
 	if challenge == nil {
-		renderChallengeNotFound(w, r, challengeID)
+		renderMissingChallenge(w, r, challengeID)
+		return
+	}
+
+	// don't let refused networks guess passwords either
+	if refuseChallengeNetwork(w, r, challenge) {
 		return
 	}
 
 	// already has access, no need for auth
-	if challenge.Accessible(r) {
+	if challenge.Accessible(r, sessionStore) {
+		if challenge.AcceptsUploads {
+			handleChallengeUpload(w, r, challenge)
+			return
+		}
 		http.Redirect(w, r, challengeURLGenerator.ViewChallengePath(challenge, filePath), http.StatusFound)
 		return
 	}
@@ -426,23 +1308,111 @@ func handleChallengeAuthentication(w http.ResponseWriter, r *http.Request, ps ht
 		return
 	}
 
-	if challenge.HasPassword {
+	if _, guessed := r.PostForm["challenge-password"]; guessed && challenge.HasPassword {
+		ip := clientIP(r)
+		// the guess counts as wrong until bcrypt says otherwise, so parallel guesses can't race the limit
+		lockout, allowed := unlockLimiter.Attempt(challenge.ID, ip)
+		if !allowed {
+			renderTooManyAttempts(w, r, lockout)
+			return
+		}
+
 		postedPassword := r.FormValue("challenge-password")
 		if challenge.CheckPassword(postedPassword) == nil {
-			challenge.StorePassword(postedPassword, w, r)
+			unlockLimiter.Succeed(challenge.ID, ip)
+			sessionStore.Unlock(challenge, w)
 			http.Redirect(w, r, r.URL.String(), http.StatusFound)
 			return
 		}
+
+		log.Printf("Wrong password for challenge %v from %v", challenge.ID, ip)
+		challengeRepository.ReportFailedUnlock(challenge, path.Clean("/"+filePath), r)
+		if lockout > 0 {
+			log.Printf("Locked %v out of challenge %v for %v", ip, challenge.ID, lockout)
+			renderTooManyAttempts(w, r, lockout)
+			return
+		}
 	}
 
 	handleChallengeFilepath(w, r, ps)
 }
 
 func handleHome(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	templates.WritePageTemplate(w, &templates.HomePage{}, &templates.PrivateNav{})
+	templates.WritePageTemplate(w, &templates.HomePage{}, privateNav(r))
 }
 
 func main() {
+	if err := runCommand(os.Args[0], os.Args[1:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+		log.Fatal(err)
+	}
+}
+
+// openChallengeRepository opens the persistent repository that the server
+// and the share subcommands all work on.
+func openChallengeRepository(config *Config) (stuff.ChallengeRepository, error) {
+	repo, err := stuff.NewFileChallengeRepository(config.ChallengesPath())
+	if err != nil {
+		return nil, fmt.Errorf("loading challenges from %v: %w", config.StateDirectory, err)
+	}
+	return repo, nil
+}
+
+func serve(name string, args []string) error {
+	var err error
+	config, _, err = loadConfig(name, args, nil)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	config.LogSummary()
+
+	challengeRepository, err = openChallengeRepository(config)
+	if err != nil {
+		return err
+	}
+
+	sessionKey, err := LoadOrCreateSecret(config.SessionKeyPath(), 32)
+	if err != nil {
+		return fmt.Errorf("loading session key: %w", err)
+	}
+	signer := &stuff.TokenSigner{Key: sessionKey}
+	sessionStore = &stuff.HMACSessionStore{
+		Signer:   signer,
+		Lifetime: config.SessionLifetime,
+	}
+
+	adminAuthenticator, err = newAdminAuthenticator(config, signer)
+	if err != nil {
+		return fmt.Errorf("setting up admin auth: %w", err)
+	}
+
+	apiTokens, err = readAPITokens(config.APITokensFile)
+	if err != nil {
+		return fmt.Errorf("loading API tokens: %w", err)
+	}
+	log.Printf("Loaded %d API tokens", len(apiTokens))
+
+	dataFileSystem = config.FileSystem()
+	useURLGenerator(config)
+	trustedProxies, err = config.TrustedProxyNetworks()
+	if err != nil {
+		return fmt.Errorf("loading trusted proxies: %w", err)
+	}
+	unlockLimiter = &stuff.UnlockLimiter{
+		Threshold:          config.UnlockMaxAttempts,
+		ChallengeThreshold: config.UnlockMaxChallengeAttempts,
+		Lockout:            config.UnlockLockout,
+		MaxLockout:         config.UnlockMaxLockout,
+	}
+
+	thumbnailGenerator = thumbnails.New(config.ThumbnailsPath(), config.ThumbnailSize, config.FFmpeg, runtime.NumCPU())
+	if thumbnailGenerator.FFmpegPath == "" {
+		log.Printf("ffmpeg not found, video thumbnails are disabled")
+	}
+
+	if config.LoadDemoFixtures {
+		loadDemoFixtures(challengeRepository)
+	}
+
 	router := httprouter.New()
 
 	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -459,20 +1429,67 @@ func main() {
 		})
 	})
 
-	router.GET("/", handleHome)
-
-	router.GET("/challenges", handleChallengesIndex)
-	router.DELETE("/challenges/:challenge", handleChallengeDelete)
-	router.POST("/challenges/:challenge/delete", handleChallengeDelete)
-
-	router.GET("/stuff/browse/*filepath", handleStuffIndex)
-	router.GET("/stuff/share/*filepath", handleStuffShowForm)
-	router.POST("/stuff/share/*filepath", handleStuffReceiveForm)
+	// routes live under the prefix, so links and redirects built from r.URL keep it
+	prefix := config.PathPrefix
+	router.GET(prefix+"/login", handleLoginForm)
+	router.POST(prefix+"/login", handleLogin)
+	router.GET(prefix+"/logout", handleLogout)
+
+	router.GET(prefix+"/", requireAdmin(handleHome))
+
+	router.GET(prefix+"/challenges", requireAdmin(handleChallengesIndex))
+	router.DELETE(prefix+"/challenges/:challenge", requireAdmin(handleChallengeDelete))
+	router.POST(prefix+"/challenges/:challenge/delete", requireAdmin(handleChallengeDelete))
+	router.GET(prefix+"/challenges/:challenge/edit", requireAdmin(handleChallengeEditForm))
+	router.GET(prefix+"/challenges/:challenge/views", requireAdmin(handleChallengeViews))
+	router.POST(prefix+"/challenges/:challenge/edit", requireAdmin(handleChallengeEdit))
+
+	router.GET(prefix+"/stuff/browse/*filepath", requireAdmin(handleStuffIndex))
+	router.GET(prefix+"/stuff/thumbnail/*filepath", requireAdmin(handleStuffThumbnail))
+	router.GET(prefix+"/stuff/share/*filepath", requireAdmin(handleStuffShowForm))
+	router.POST(prefix+"/stuff/share/*filepath", requireAdmin(handleStuffReceiveForm))
+
+	router.GET(prefix+"/api/v1/challenges", requireAPIToken(handleAPIChallengesIndex))
+	router.POST(prefix+"/api/v1/challenges", requireAPIToken(handleAPIChallengeCreate))
+	router.GET(prefix+"/api/v1/challenges/:challenge", requireAPIToken(handleAPIChallengeShow))
+	router.PATCH(prefix+"/api/v1/challenges/:challenge", requireAPIToken(handleAPIChallengeUpdate))
+	router.DELETE(prefix+"/api/v1/challenges/:challenge", requireAPIToken(handleAPIChallengeDelete))
+	router.GET(prefix+"/api/v1/challenges/:challenge/views", requireAPIToken(handleAPIChallengeViews))
+
+	router.GET(prefix+"/view/:challenge", handleChallengeFilepath)
+	router.GET(prefix+"/view/:challenge/*filepath", handleChallengeFilepath)
+	router.POST(prefix+"/view/:challenge", handleChallengeAuthentication)
+	router.POST(prefix+"/view/:challenge/*filepath", handleChallengeAuthentication)
+
+	// stop on ctrl-c or docker stop, letting requests and the janitor finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var background sync.WaitGroup
+	if config.JanitorInterval > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			runJanitor(ctx, challengeRepository, config.JanitorInterval, config.JanitorRetention, config.JanitorAction)
+		}()
+	}
 
-	router.GET("/view/:challenge", handleChallengeFilepath)
-	router.GET("/view/:challenge/*filepath", handleChallengeFilepath)
-	router.POST("/view/:challenge", handleChallengeAuthentication)
-	router.POST("/view/:challenge/*filepath", handleChallengeAuthentication)
+	server := &http.Server{Addr: config.ListenAddress, Handler: withClientIP(router)}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+		log.Printf("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err = server.Shutdown(shutdownCtx)
+	}
 
-	log.Fatal(http.ListenAndServe(":8080", router))
+	stop()
+	background.Wait()
+	return err
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestClientIPOnlyBelievesTrustedProxies(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies = []*net.IPNet{proxies}
+	defer func() { trustedProxies = nil }()
+
+	cases := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"192.0.2.1:1234", "203.0.113.9", "192.0.2.1"},
+		{"10.0.0.2:1234", "203.0.113.9", "203.0.113.9"},
+		// the client can prepend anything, only the entry our proxy added counts
+		{"10.0.0.2:1234", "198.51.100.1, 203.0.113.9", "203.0.113.9"},
+		{"10.0.0.2:1234", "203.0.113.9, 10.0.0.3", "203.0.113.9"},
+		{"10.0.0.2:1234", "", "10.0.0.2"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if ip := clientIP(r); ip != c.expected {
+			t.Errorf("%v forwarding %q: expected %v but got %v", c.remoteAddr, c.forwarded, c.expected, ip)
+		}
+	}
+}
+
+func TestDeniedNetworksDontLearnLinkIsDead(t *testing.T) {
+	challengeRepository = stuff.NewArrayChallengeRepository()
+	defer func() { challengeRepository = nil }()
+
+	challenge := &stuff.Challenge{ID: "foo", Public: true, DeniedNetworks: []string{"192.0.2.0/24"}}
+	challenge.SetExpirationDate(time.Now().Add(-time.Hour))
+	challengeRepository.Set(challenge)
+
+	cases := map[string]int{
+		"192.0.2.1:1234":    http.StatusForbidden,
+		"198.51.100.1:1234": http.StatusGone,
+	}
+	for remoteAddr, expected := range cases {
+		r := httptest.NewRequest("GET", "/view/foo/", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handleChallengeFilepath(w, r, httprouter.Params{{Key: "challenge", Value: "foo"}, {Key: "filepath", Value: "/"}})
+		if w.Code != expected {
+			t.Errorf("%v: expected %d but got %d", remoteAddr, expected, w.Code)
+		}
+	}
+}
+
+func TestMistypedShortCodesRedirect(t *testing.T) {
+	challengeRepository = stuff.NewArrayChallengeRepository()
+	defer func() { challengeRepository = nil }()
+	challengeRepository.Set(&stuff.Challenge{ID: "AB1C0D2E", Public: true})
+
+	r := httptest.NewRequest("GET", "/view/abicod2e/docs?grid=1", nil)
+	w := httptest.NewRecorder()
+	handleChallengeFilepath(w, r, httprouter.Params{{Key: "challenge", Value: "abicod2e"}, {Key: "filepath", Value: "/docs"}})
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/view/AB1C0D2E/docs?grid=1" {
+		t.Errorf("expected a redirect to /view/AB1C0D2E/docs?grid=1 but got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+}
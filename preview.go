@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/AlbinoDrought/creamy-stuff/previews"
+	"github.com/AlbinoDrought/creamy-stuff/templates"
+)
+
+// buildPreviewPage works out how to show the file at filePath inline.
+// When embed is false nothing is read from the file beyond its type, and the
+// caller should explain why in Message. Text is only read into the page when
+// inlineText is also true, otherwise it has to be opened like any other file.
+func buildPreviewPage(name string, filePath string, embed bool, inlineText bool) (*templates.PreviewPage, error) {
+	contentType, err := previews.ContentType(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &templates.PreviewPage{
+		Name:        name,
+		Kind:        previews.Kind(name, contentType),
+		ContentType: contentType,
+		Embed:       embed,
+	}
+	if !embed {
+		return page, nil
+	}
+
+	switch page.Kind {
+	case previews.KindMarkdown, previews.KindText:
+		if !inlineText {
+			page.Message = "Open this file to read it."
+			return page, nil
+		}
+
+		content, ok, err := previews.ReadText(filePath)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			page.Message = "This file is too large to preview."
+			return page, nil
+		}
+
+		if page.Kind == previews.KindMarkdown {
+			page.HTML, err = previews.RenderMarkdown(content)
+		} else {
+			page.HTML, err = previews.RenderText(name, content)
+		}
+		if err != nil {
+			return nil, err
+		}
+	case previews.KindNone:
+		page.Message = "No preview available for this file."
+	}
+
+	return page, nil
+}
+
+// inlineContentTypes can be shown by the browser without running anything in our origin.
+// HTML, SVG and the like could be uploaded by anyone with a file request link.
+var inlineContentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/avif":      true,
+	"image/bmp":       true,
+	"image/gif":       true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/webp":      true,
+	"text/plain":      true,
+}
+
+func isInlineContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return inlineContentTypes[mediaType] || strings.HasPrefix(mediaType, "audio/") || strings.HasPrefix(mediaType, "video/")
+}
+
+// serveFile sends a file either inline, to be shown by the browser, or as an attachment to be saved.
+// Types that aren't safe to show are always sent as attachments.
+func serveFile(w http.ResponseWriter, r *http.Request, filePath string, name string, attachment bool) {
+	contentType, err := previews.ContentType(filePath)
+	if err != nil || !isInlineContentType(contentType) {
+		attachment = true
+	}
+	if err == nil {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	disposition := "inline"
+	if attachment {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=\"%s\"", disposition, name))
+	http.ServeFile(w, r, filePath)
+}
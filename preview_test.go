@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServeFileOnlyShowsSafeTypesInline(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]bool{
+		"notes.txt":    true,
+		"photo.png":    true,
+		"movie.mp4":    true,
+		"page.html":    false,
+		"image.svg":    false,
+		"script.js":    false,
+		"no-extension": false,
+	}
+	for name, inline := range cases {
+		filePath := filepath.Join(dir, name)
+		if err := os.WriteFile(filePath, []byte("<html><script>alert(1)</script></html>"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		serveFile(w, httptest.NewRequest("GET", "/"+name+"?raw=1", nil), filePath, name, false)
+		if disposition := w.Header().Get("Content-Disposition"); strings.HasPrefix(disposition, "inline") != inline {
+			t.Errorf("%v: expected inline %v but got %q", name, inline, disposition)
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%v: expected nosniff", name)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Package previews decides how a file can be shown in the browser
+// and renders text files to HTML.
+package previews
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+const (
+	KindImage    = "image"
+	KindVideo    = "video"
+	KindAudio    = "audio"
+	KindPDF      = "pdf"
+	KindMarkdown = "markdown"
+	KindText     = "text"
+	KindNone     = "none"
+)
+
+// MaxTextSize is the largest text file rendered inline. Bigger ones can only be downloaded.
+const MaxTextSize = 1024 * 1024
+
+const highlightStyle = "monokai"
+
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// ContentType guesses a file's content type from its extension, falling back to sniffing its first bytes.
+func ContentType(filePath string) (string, error) {
+	if contentType := mime.TypeByExtension(filepath.Ext(filePath)); contentType != "" {
+		return contentType, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	return http.DetectContentType(head[:n]), nil
+}
+
+// Kind picks how to preview a file with this name and content type.
+func Kind(name string, contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch ext := strings.ToLower(filepath.Ext(name)); {
+	case ext == ".md" || ext == ".markdown" || mediaType == "text/markdown":
+		return KindMarkdown
+	case strings.HasPrefix(mediaType, "image/"):
+		return KindImage
+	case strings.HasPrefix(mediaType, "video/"):
+		return KindVideo
+	case strings.HasPrefix(mediaType, "audio/"):
+		return KindAudio
+	case mediaType == "application/pdf":
+		return KindPDF
+	case strings.HasPrefix(mediaType, "text/"),
+		mediaType == "application/json",
+		mediaType == "application/xml",
+		mediaType == "application/javascript",
+		mediaType == "application/x-sh",
+		lexers.Match(name) != nil:
+		return KindText
+	}
+
+	return KindNone
+}
+
+// ReadText reads a text file for rendering. ok is false if the file is too big or isn't valid UTF-8.
+func ReadText(filePath string) (content []byte, ok bool, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	content, err = io.ReadAll(io.LimitReader(file, MaxTextSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(content) > MaxTextSize || !utf8.Valid(content) {
+		return nil, false, nil
+	}
+
+	return content, true, nil
+}
+
+// RenderMarkdown renders markdown to HTML. Raw HTML and dangerous links in the source are dropped.
+func RenderMarkdown(content []byte) (string, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert(content, &buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// RenderText renders text to syntax-highlighted HTML, picking a lexer by file name or content.
+func RenderText(name string, content []byte) (string, error) {
+	lexer := lexers.Match(name)
+	if lexer == nil {
+		lexer = lexers.Analyse(string(content))
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+
+	style := styles.Get(highlightStyle)
+	formatter := chromahtml.New(chromahtml.WithLineNumbers(true), chromahtml.TabWidth(4))
+
+	iterator, err := lexer.Tokenise(nil, string(content))
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := formatter.Format(&buf, style, iterator); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,53 @@
+package previews
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKind(t *testing.T) {
+	cases := map[string]string{
+		"photo.jpg":  KindImage,
+		"clip.webm":  KindVideo,
+		"song.mp3":   KindAudio,
+		"paper.pdf":  KindPDF,
+		"README.md":  KindMarkdown,
+		"main.go":    KindText,
+		"notes.txt":  KindText,
+		"backup.bin": KindNone,
+	}
+
+	for name, expected := range cases {
+		contentType, _ := ContentType(name)
+		if actual := Kind(name, contentType); actual != expected {
+			t.Errorf("expected %s to be %s but got %s", name, expected, actual)
+		}
+	}
+}
+
+func TestReadTextRejectsLargeFiles(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "big.txt")
+	if err := os.WriteFile(filePath, []byte(strings.Repeat("a", MaxTextSize+1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, ok, err := ReadText(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expected file over MaxTextSize not to be read")
+	}
+}
+
+func TestRenderMarkdownDropsRawHTML(t *testing.T) {
+	html, err := RenderMarkdown([]byte("# hi\n\n<script>alert(1)</script>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(html, "<script>") {
+		t.Errorf("expected raw HTML to be dropped but got %s", html)
+	}
+}
@@ -3,6 +3,11 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 func RandomBytes(n int) ([]byte, error) {
@@ -17,3 +22,57 @@ func RandomString(n int) (string, error) {
 	bytes, err := RandomBytes(n)
 	return base64.URLEncoding.EncodeToString(bytes), err
 }
+
+// crockfordAlphabet is Crockford's base32, which leaves out I, L, O and U
+// so codes can't be misread or spell much.
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// RandomCode returns n random Crockford base32 characters.
+func RandomCode(n int) (string, error) {
+	bytes, err := RandomBytes(n)
+	if err != nil {
+		return "", err
+	}
+
+	code := make([]byte, n)
+	for i, b := range bytes {
+		// 256 is a multiple of 32, so this isn't biased
+		code[i] = crockfordAlphabet[b%32]
+	}
+	return string(code), nil
+}
+
+// LoadOrCreateSecret reads a hex-encoded secret from filePath,
+// generating and saving n random bytes there if it does not exist yet.
+// A secret shorter than n bytes is an error rather than replaced, since
+// anything signed with it could be forged.
+func LoadOrCreateSecret(filePath string, n int) ([]byte, error) {
+	contents, err := os.ReadFile(filePath)
+	if err == nil {
+		secret, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filePath, err)
+		}
+		if len(secret) < n {
+			return nil, fmt.Errorf("%s holds a %d byte secret, but at least %d are needed; delete it to generate a new one", filePath, len(secret), n)
+		}
+		return secret, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	secret, err := RandomBytes(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filePath, []byte(hex.EncodeToString(secret)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateSecret(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "state", "session.key")
+
+	secret, err := LoadOrCreateSecret(filePath, 32)
+	if err != nil || len(secret) != 32 {
+		t.Fatalf("expected a new 32 byte secret but got %d bytes, %v", len(secret), err)
+	}
+	loaded, err := LoadOrCreateSecret(filePath, 32)
+	if err != nil || !bytes.Equal(loaded, secret) {
+		t.Errorf("expected the saved secret back but got %x, %v", loaded, err)
+	}
+
+	for name, contents := range map[string]string{"empty": "", "truncated": "abcd\n", "not hex": "zz"} {
+		if err := os.WriteFile(filePath, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if secret, err := LoadOrCreateSecret(filePath, 32); err == nil {
+			t.Errorf("%s: expected an error but loaded %x", name, secret)
+		}
+		if after, _ := os.ReadFile(filePath); string(after) != contents {
+			t.Errorf("%s: expected the key file to be left alone but it holds %q", name, after)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Package safefs serves files from a directory without letting symlinks lead
+// outside of it, and hides dotfiles and ignored files as if they didn't exist.
+package safefs
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// SymlinksFollow follows symlinks whose targets stay inside the root.
+	SymlinksFollow = "follow"
+	// SymlinksDeny treats every symlink as missing.
+	SymlinksDeny = "deny"
+)
+
+// deniedError is returned for paths we refuse to open. It counts as fs.ErrNotExist,
+// so hidden and escaping files look exactly like missing ones.
+type deniedError struct {
+	reason string
+}
+
+func (err *deniedError) Error() string {
+	return err.reason
+}
+
+func (err *deniedError) Is(target error) bool {
+	return target == fs.ErrNotExist
+}
+
+var (
+	ErrHidden      error = &deniedError{"file is hidden"}
+	ErrOutsideRoot error = &deniedError{"path resolves outside the root directory"}
+	ErrSymlink     error = &deniedError{"symlinks are not allowed"}
+)
+
+// FileSystem is an http.FileSystem rooted at Root. Names are slash-separated and
+// relative to Root; ".." can't climb above it.
+type FileSystem struct {
+	Root string
+	// Symlinks is SymlinksFollow or SymlinksDeny.
+	Symlinks string
+	// HideDotfiles hides every file and directory whose name starts with a dot.
+	HideDotfiles bool
+	// Ignore hides files matching any of these path.Match globs. Globs are matched
+	// against each name in a path, and against the whole path without its leading slash.
+	Ignore []string
+
+	// base is the directory a Sub is for, relative to Root, and resolvedBase where it is on disk.
+	// Names are relative to base, but hidden files are still matched from Root.
+	base         string
+	resolvedBase string
+}
+
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+// Hidden reports whether name, or any directory it is in, is a dotfile or ignored.
+func (fsys *FileSystem) Hidden(name string) bool {
+	name = strings.TrimPrefix(path.Join(fsys.base, clean(name)), "/")
+	if name == "" {
+		return false
+	}
+
+	for _, segment := range strings.Split(name, "/") {
+		if fsys.HideDotfiles && strings.HasPrefix(segment, ".") {
+			return true
+		}
+		for _, glob := range fsys.Ignore {
+			if matched, _ := path.Match(glob, segment); matched {
+				return true
+			}
+		}
+	}
+	for _, glob := range fsys.Ignore {
+		if matched, _ := path.Match(glob, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Resolve returns the real path on disk of name, after following symlinks.
+func (fsys *FileSystem) Resolve(name string) (string, error) {
+	name = clean(name)
+	if fsys.Hidden(name) {
+		return "", &os.PathError{Op: "open", Path: name, Err: ErrHidden}
+	}
+
+	root := fsys.resolvedBase
+	if root == "" {
+		var err error
+		if root, err = filepath.EvalSymlinks(fsys.Root); err != nil {
+			return "", err
+		}
+	}
+
+	joined := filepath.Join(root, filepath.FromSlash(name))
+	resolved, err := filepath.EvalSymlinks(joined)
+	if err != nil {
+		return "", err
+	}
+	if resolved == joined {
+		return resolved, nil
+	}
+
+	// a symlink was followed somewhere along the way
+	if fsys.Symlinks != SymlinksFollow {
+		return "", &os.PathError{Op: "open", Path: name, Err: ErrSymlink}
+	}
+
+	relative, err := filepath.Rel(root, resolved)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", &os.PathError{Op: "open", Path: name, Err: ErrOutsideRoot}
+	}
+	if fsys.Hidden(filepath.ToSlash(relative)) {
+		return "", &os.PathError{Op: "open", Path: name, Err: ErrHidden}
+	}
+
+	return resolved, nil
+}
+
+// Sub returns a FileSystem for the directory name, with the same rules.
+// Names are relative to name, and symlinks inside it may not lead back out of it,
+// but ignore globs still match whole paths from Root.
+func (fsys *FileSystem) Sub(name string) (*FileSystem, error) {
+	resolved, err := fsys.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := *fsys
+	sub.base = path.Join(fsys.base, clean(name))
+	sub.resolvedBase = resolved
+	return &sub, nil
+}
+
+func (fsys *FileSystem) Open(name string) (http.File, error) {
+	resolved, err := fsys.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	return &dirFile{File: file, fsys: fsys, name: clean(name)}, nil
+}
+
+// Walk calls fn for every visible regular file under name, following symlinks
+// like Open does. Symlinks back to a directory being walked are skipped, so loops end.
+func (fsys *FileSystem) Walk(name string, fn func(name string, resolved string, info os.FileInfo) error) error {
+	walking := map[string]bool{}
+
+	var walk func(name string) error
+	walk = func(name string) error {
+		resolved, err := fsys.Resolve(name)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(resolved)
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			return fn(name, resolved, info)
+		}
+		if !info.IsDir() || walking[resolved] {
+			return nil
+		}
+		walking[resolved] = true
+		defer delete(walking, resolved)
+
+		entries, err := os.ReadDir(resolved)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err := walk(path.Join(name, entry.Name()))
+			if errors.Is(err, fs.ErrNotExist) {
+				// hidden, pointing somewhere it shouldn't, or deleted since ReadDir
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return walk(clean(name))
+}
+
+// dirFile filters directory listings through its FileSystem's rules.
+type dirFile struct {
+	*os.File
+	fsys *FileSystem
+	name string
+}
+
+// linkInfo describes a symlink's target under the symlink's own name.
+type linkInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (info *linkInfo) Name() string {
+	return info.name
+}
+
+func (file *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := file.File.Readdir(count)
+
+	visible := entries[:0]
+	for _, entry := range entries {
+		name := path.Join(file.name, entry.Name())
+		if file.fsys.Hidden(name) {
+			continue
+		}
+
+		if entry.Mode()&os.ModeSymlink != 0 {
+			resolved, err := file.fsys.Resolve(name)
+			if err != nil {
+				continue
+			}
+			target, err := os.Stat(resolved)
+			if err != nil {
+				continue
+			}
+			entry = &linkInfo{FileInfo: target, name: entry.Name()}
+		}
+
+		visible = append(visible, entry)
+	}
+
+	return visible, err
+}
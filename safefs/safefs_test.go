@@ -0,0 +1,248 @@
+package safefs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func writeFile(t *testing.T, filePath string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func symlink(t *testing.T, target string, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+}
+
+// newTestFileSystem builds:
+//
+//	outside/secret.txt
+//	root/a.txt
+//	root/.env
+//	root/notes.tmp
+//	root/sub/b.txt
+//	root/sub/.git/config
+//	root/escape -> ../outside
+//	root/escape.txt -> ../outside/secret.txt
+//	root/inside -> sub
+//	root/inside.txt -> a.txt
+//	root/sub/loop -> ..
+func newTestFileSystem(t *testing.T, symlinks string) *FileSystem {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+
+	writeFile(t, filepath.Join(dir, "outside", "secret.txt"))
+	writeFile(t, filepath.Join(root, "a.txt"))
+	writeFile(t, filepath.Join(root, ".env"))
+	writeFile(t, filepath.Join(root, "notes.tmp"))
+	writeFile(t, filepath.Join(root, "sub", "b.txt"))
+	writeFile(t, filepath.Join(root, "sub", ".git", "config"))
+	symlink(t, filepath.Join("..", "outside"), filepath.Join(root, "escape"))
+	symlink(t, filepath.Join("..", "outside", "secret.txt"), filepath.Join(root, "escape.txt"))
+	symlink(t, "sub", filepath.Join(root, "inside"))
+	symlink(t, "a.txt", filepath.Join(root, "inside.txt"))
+	symlink(t, "..", filepath.Join(root, "sub", "loop"))
+
+	return &FileSystem{
+		Root:         root,
+		Symlinks:     symlinks,
+		HideDotfiles: true,
+		Ignore:       []string{"*.tmp"},
+	}
+}
+
+func TestOpenAllowed(t *testing.T) {
+	fsys := newTestFileSystem(t, SymlinksFollow)
+
+	for _, name := range []string{"/", "/a.txt", "sub/b.txt", "/inside/b.txt", "/inside.txt", "/sub/loop/a.txt"} {
+		file, err := fsys.Open(name)
+		if err != nil {
+			t.Errorf("Open(%q): %v", name, err)
+			continue
+		}
+		file.Close()
+	}
+}
+
+func TestOpenDenied(t *testing.T) {
+	fsys := newTestFileSystem(t, SymlinksFollow)
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"/../outside/secret.txt", fs.ErrNotExist},
+		{"../../outside/secret.txt", fs.ErrNotExist},
+		{"/sub/../../outside/secret.txt", fs.ErrNotExist},
+		{"/escape/secret.txt", ErrOutsideRoot},
+		{"/escape.txt", ErrOutsideRoot},
+		{"/.env", ErrHidden},
+		{"/sub/.git/config", ErrHidden},
+		{"/notes.tmp", ErrHidden},
+		{"/missing.txt", fs.ErrNotExist},
+	}
+
+	for _, test := range tests {
+		file, err := fsys.Open(test.name)
+		if err == nil {
+			file.Close()
+			t.Errorf("Open(%q) should have failed", test.name)
+			continue
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("Open(%q) = %v, want %v", test.name, err, test.err)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Open(%q) = %v, should look like a missing file", test.name, err)
+		}
+	}
+}
+
+func TestOpenSymlinksDenied(t *testing.T) {
+	fsys := newTestFileSystem(t, SymlinksDeny)
+
+	for _, name := range []string{"/inside/b.txt", "/inside.txt", "/escape.txt"} {
+		file, err := fsys.Open(name)
+		if err == nil {
+			file.Close()
+			t.Errorf("Open(%q) should have failed", name)
+			continue
+		}
+		if name != "/escape.txt" && !errors.Is(err, ErrSymlink) {
+			t.Errorf("Open(%q) = %v, want %v", name, err, ErrSymlink)
+		}
+	}
+
+	file, err := fsys.Open("/sub/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+}
+
+func TestSymlinkedRoot(t *testing.T) {
+	fsys := newTestFileSystem(t, SymlinksDeny)
+	link := filepath.Join(t.TempDir(), "data")
+	symlink(t, fsys.Root, link)
+	fsys.Root = link
+
+	file, err := fsys.Open("/a.txt")
+	if err != nil {
+		t.Fatalf("the root itself may be a symlink: %v", err)
+	}
+	file.Close()
+}
+
+func readdirNames(t *testing.T, fsys *FileSystem, name string) []string {
+	t.Helper()
+	file, err := fsys.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	entries, err := file.Readdir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name()+"/")
+		} else {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func assertNames(t *testing.T, got []string, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestReaddirFilters(t *testing.T) {
+	fsys := newTestFileSystem(t, SymlinksFollow)
+	assertNames(t, readdirNames(t, fsys, "/"), []string{"a.txt", "inside.txt", "inside/", "sub/"})
+
+	fsys = newTestFileSystem(t, SymlinksDeny)
+	assertNames(t, readdirNames(t, fsys, "/"), []string{"a.txt", "sub/"})
+}
+
+func TestSubKeepsSymlinksInside(t *testing.T) {
+	fsys := newTestFileSystem(t, SymlinksFollow)
+
+	sub, err := fsys.Sub("/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := sub.Open("/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if _, err := sub.Open("/loop/a.txt"); !errors.Is(err, ErrOutsideRoot) {
+		t.Fatalf("symlink out of the sub directory: got %v, want %v", err, ErrOutsideRoot)
+	}
+	if _, err := sub.Open("/../a.txt"); err == nil {
+		t.Fatal("traversal out of the sub directory should fail")
+	}
+}
+
+func TestSubMatchesIgnoreGlobsFromRoot(t *testing.T) {
+	fsys := newTestFileSystem(t, SymlinksFollow)
+	fsys.Ignore = append(fsys.Ignore, "sub/b.txt")
+	writeFile(t, filepath.Join(fsys.Root, "sub", "c.txt"))
+
+	if _, err := fsys.Open("/sub/b.txt"); !errors.Is(err, ErrHidden) {
+		t.Fatalf("Open(/sub/b.txt): got %v, want %v", err, ErrHidden)
+	}
+
+	sub, err := fsys.Sub("/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sub.Open("/b.txt"); !errors.Is(err, ErrHidden) {
+		t.Fatalf("Open(/b.txt) in /sub: got %v, want %v", err, ErrHidden)
+	}
+	assertNames(t, readdirNames(t, sub, "/"), []string{"c.txt"})
+}
+
+func TestWalk(t *testing.T) {
+	fsys := newTestFileSystem(t, SymlinksFollow)
+
+	names := []string{}
+	err := fsys.Walk("/", func(name string, resolved string, info os.FileInfo) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+
+	// sub/loop leads back to the root being walked, so it's skipped
+	assertNames(t, names, []string{"/a.txt", "/inside.txt", "/inside/b.txt", "/sub/b.txt"})
+}
@@ -2,7 +2,13 @@ package stuff
 
 import (
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -12,23 +18,97 @@ type Challenge struct {
 	ID         string
 	Public     bool
 	SharedPath string
+	// SharedPaths shares several paths at once, side by side in a virtual root
+	// directory. SharedPath is empty when they are set.
+	SharedPaths []string `json:",omitempty"`
+
+	// Note is a free-text reminder for admins, like who the link was sent to
+	Note string `json:",omitempty"`
+
+	// Disabled turns the link off without deleting it
+	Disabled bool
+	// Archived challenges are dead ones kept for their history, hidden from queries by default
+	Archived bool `json:",omitempty"`
+
+	// AllowedNetworks and DeniedNetworks are CIDRs the link can or can't be opened from, see NetworkRule.
+	AllowedNetworks []string `json:",omitempty"`
+	DeniedNetworks  []string `json:",omitempty"`
 
 	HasPassword  bool
 	PasswordHash string
+	// SessionVersion is bumped to sign out everyone who unlocked the challenge
+	SessionVersion int
 
 	Expires    bool
 	ValidUntil time.Time
+	// HasValidFrom keeps the link closed until ValidFrom, for embargoed releases
+	HasValidFrom bool      `json:",omitempty"`
+	ValidFrom    time.Time `json:",omitempty"`
 
 	HasViewCountLimit bool
 	MaxViewCount      int
 	ViewCount         int
+	// ViewCounting is one of ViewCountings, empty for ViewCountingRequest
+	ViewCounting string `json:",omitempty"`
+	// ViewLimitPerFile applies MaxViewCount to each file on its own instead of the whole share
+	ViewLimitPerFile bool `json:",omitempty"`
+	// FileViewCounts counts views by file path, like ViewCount does for the whole share
+	FileViewCounts map[string]int `json:",omitempty"`
+
+	// MaxServedBytes limits the bytes downloaded in total, 0 for no limit.
+	MaxServedBytes int64 `json:",omitempty"`
+	ServedBytes    int64 `json:",omitempty"`
+	// MaxBytesPerSecond throttles each download, 0 for full speed.
+	MaxBytesPerSecond int64 `json:",omitempty"`
+
+	// AcceptsUploads makes the challenge a file request: instead of browsing
+	// SharedPath, visitors get a form to upload files into it.
+	AcceptsUploads bool
+	// MaxUploadBytes and MaxUploadFiles limit all uploads together, 0 for no limit.
+	MaxUploadBytes int64
+	MaxUploadFiles int
+	// AllowedExtensions like ".pdf" restrict uploaded file names, empty allows any.
+	AllowedExtensions []string
+	UploadedBytes     int64
+	UploadedFiles     int
 
 	views []*ChallengeView
 }
 
+// ChallengeTombstone remembers a removed challenge, so its link can say it expired
+// instead of claiming it never existed.
+type ChallengeTombstone struct {
+	ID        string
+	RemovedAt time.Time
+}
+
 type ChallengeView struct {
 	Time time.Time
 	IP   string
+
+	// Upload is set when FilePath was uploaded rather than viewed
+	Upload bool `json:",omitempty"`
+	// FailedUnlock is set for a wrong password guess, which doesn't count as a view
+	FailedUnlock bool   `json:",omitempty"`
+	FilePath     string `json:",omitempty"`
+	UserAgent    string `json:",omitempty"`
+	// NetworkRule is the allow rule that let IP in, if the challenge has network rules
+	NetworkRule string `json:",omitempty"`
+	// Visitor tells apart who viewed, see VisitorCookieName
+	Visitor string `json:",omitempty"`
+	// Uncounted views didn't use up one of the challenge's views, see ViewCounting
+	Uncounted bool `json:",omitempty"`
+	// Offset is where in the file the bytes sent started, for range requests.
+	Offset int64 `json:",omitempty"`
+	// Bytes, Status and Complete are filled in by CompleteChallengeView once the response is sent.
+	// For uploads, Bytes is the size of the uploaded file. Complete is set when the file
+	// was sent through to its end.
+	Bytes    int64 `json:",omitempty"`
+	Status   int   `json:",omitempty"`
+	Complete bool  `json:",omitempty"`
+
+	// index finds the view again in CompleteChallengeView
+	index int
 }
 
 func (challenge *Challenge) Views() []*ChallengeView {
@@ -39,6 +119,48 @@ func (challenge *Challenge) Views() []*ChallengeView {
 	return challenge.views
 }
 
+// Paths lists every path the challenge shares.
+func (challenge *Challenge) Paths() []string {
+	if len(challenge.SharedPaths) > 0 {
+		return challenge.SharedPaths
+	}
+	return []string{challenge.SharedPath}
+}
+
+// DisplayPath describes what the challenge shares, for lists and titles.
+func (challenge *Challenge) DisplayPath() string {
+	return strings.Join(challenge.Paths(), ", ")
+}
+
+// SharedEntry is one of a multi-path challenge's paths, under its name in the virtual root.
+type SharedEntry struct {
+	Name string
+	Path string
+}
+
+// SharedEntries names each of SharedPaths after its last element,
+// numbering clashes like "notes (2).txt".
+func (challenge *Challenge) SharedEntries() []SharedEntry {
+	entries := make([]SharedEntry, 0, len(challenge.SharedPaths))
+	taken := map[string]bool{}
+	for _, sharedPath := range challenge.SharedPaths {
+		base := path.Base(path.Clean("/" + sharedPath))
+		if base == "/" {
+			base = "files"
+		}
+
+		name := base
+		ext := path.Ext(base)
+		for i := 2; taken[name]; i++ {
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(base, ext), i, ext)
+		}
+		taken[name] = true
+
+		entries = append(entries, SharedEntry{Name: name, Path: sharedPath})
+	}
+	return entries
+}
+
 func (challenge *Challenge) CookieName() string {
 	return hex.EncodeToString([]byte(challenge.ID))
 }
@@ -51,8 +173,136 @@ func (challenge *Challenge) Expired() bool {
 	return time.Now().After(challenge.ValidUntil)
 }
 
+// NotYetValid checks if the challenge is waiting for ValidFrom.
+func (challenge *Challenge) NotYetValid() bool {
+	if !challenge.HasValidFrom {
+		return false
+	}
+
+	return time.Now().Before(challenge.ValidFrom)
+}
+
+// HitMaxViewCount checks if the whole share used up its views.
+// Shares with ViewLimitPerFile never do, only their files, see RemainingViews.
 func (challenge *Challenge) HitMaxViewCount() bool {
-	return challenge.HasViewCountLimit && challenge.ViewCount >= challenge.MaxViewCount
+	return challenge.HasViewCountLimit && !challenge.ViewLimitPerFile && challenge.ViewCount >= challenge.MaxViewCount
+}
+
+// RemainingViews is how many more views filePath may use, or -1 without a limit.
+func (challenge *Challenge) RemainingViews(filePath string) int {
+	if !challenge.HasViewCountLimit {
+		return -1
+	}
+
+	viewCount := challenge.ViewCount
+	if challenge.ViewLimitPerFile {
+		viewCount = challenge.FileViewCounts[path.Clean("/"+filePath)]
+	}
+	if viewCount >= challenge.MaxViewCount {
+		return 0
+	}
+	return challenge.MaxViewCount - viewCount
+}
+
+// FileViews is how often one file of a challenge was viewed.
+type FileViews struct {
+	FilePath       string
+	ViewCount      int
+	RemainingViews int
+}
+
+// FileViews lists FileViewCounts by path, with the views each file has left.
+func (challenge *Challenge) FileViews() []FileViews {
+	fileViews := make([]FileViews, 0, len(challenge.FileViewCounts))
+	for filePath, viewCount := range challenge.FileViewCounts {
+		fileViews = append(fileViews, FileViews{
+			FilePath:       filePath,
+			ViewCount:      viewCount,
+			RemainingViews: challenge.RemainingViews(filePath),
+		})
+	}
+	sort.Slice(fileViews, func(i, j int) bool { return fileViews[i].FilePath < fileViews[j].FilePath })
+	return fileViews
+}
+
+// ResetViewCount forgets all views counted so far, for the whole share and each file.
+func (challenge *Challenge) ResetViewCount() {
+	challenge.ViewCount = 0
+	challenge.FileViewCounts = nil
+}
+
+// RemainingServedBytes is how much more can be downloaded, or -1 without a limit.
+func (challenge *Challenge) RemainingServedBytes() int64 {
+	if challenge.MaxServedBytes <= 0 {
+		return -1
+	}
+	if challenge.ServedBytes >= challenge.MaxServedBytes {
+		return 0
+	}
+	return challenge.MaxServedBytes - challenge.ServedBytes
+}
+
+func (challenge *Challenge) HitByteQuota() bool {
+	return challenge.RemainingServedBytes() == 0
+}
+
+// DeadSince is when an expired or exhausted challenge stopped working.
+// ok is false if it still works, or was disabled by hand.
+func (challenge *Challenge) DeadSince() (since time.Time, ok bool) {
+	if challenge.Expired() {
+		return challenge.ValidUntil, true
+	}
+	if challenge.HitMaxViewCount() || challenge.HitByteQuota() {
+		// the last view used up the limit
+		for _, view := range challenge.views {
+			if !view.Upload && !view.FailedUnlock && view.Time.After(since) {
+				since = view.Time
+			}
+		}
+		return since, true
+	}
+	return time.Time{}, false
+}
+
+// AllowsExtension checks an uploaded file name against AllowedExtensions.
+func (challenge *Challenge) AllowsExtension(name string) bool {
+	if len(challenge.AllowedExtensions) == 0 {
+		return true
+	}
+
+	ext := strings.ToLower(path.Ext(name))
+	for _, allowed := range challenge.AllowedExtensions {
+		if ext == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// RemainingUploadBytes is how much more may be uploaded, or -1 if there is no limit.
+func (challenge *Challenge) RemainingUploadBytes() int64 {
+	if challenge.MaxUploadBytes <= 0 {
+		return -1
+	}
+	if challenge.UploadedBytes >= challenge.MaxUploadBytes {
+		return 0
+	}
+	return challenge.MaxUploadBytes - challenge.UploadedBytes
+}
+
+// RemainingUploadFiles is how many more files may be uploaded, or -1 if there is no limit.
+func (challenge *Challenge) RemainingUploadFiles() int {
+	if challenge.MaxUploadFiles <= 0 {
+		return -1
+	}
+	if challenge.UploadedFiles >= challenge.MaxUploadFiles {
+		return 0
+	}
+	return challenge.MaxUploadFiles - challenge.UploadedFiles
+}
+
+func (challenge *Challenge) HitUploadLimit() bool {
+	return challenge.RemainingUploadBytes() == 0 || challenge.RemainingUploadFiles() == 0
 }
 
 func (challenge *Challenge) SetMaxViewCount(maxViewCount int) {
@@ -65,37 +315,78 @@ func (challenge *Challenge) SetExpirationDate(date time.Time) {
 	challenge.ValidUntil = date
 }
 
-func (challenge *Challenge) SetPassword(password string) error {
+func (challenge *Challenge) SetValidFrom(date time.Time) {
+	challenge.HasValidFrom = true
+	challenge.ValidFrom = date
+}
+
+func (challenge *Challenge) RemoveValidFrom() {
+	challenge.HasValidFrom = false
+	challenge.ValidFrom = time.Time{}
+}
+
+func (challenge *Challenge) RemoveMaxViewCount() {
+	challenge.HasViewCountLimit = false
+	challenge.MaxViewCount = 0
+}
+
+func (challenge *Challenge) RemoveExpirationDate() {
+	challenge.Expires = false
+	challenge.ValidUntil = time.Time{}
+}
+
+// HashPassword hashes a challenge password so it can be set later with SetPasswordHash,
+// without holding any locks while bcrypt runs.
+func HashPassword(password string) (string, error) {
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(passwordHash), err
+}
+
+func (challenge *Challenge) SetPasswordHash(passwordHash string) {
+	challenge.HasPassword = true
+	challenge.PasswordHash = passwordHash
+}
+
+func (challenge *Challenge) SetPassword(password string) error {
+	passwordHash, err := HashPassword(password)
 	if err != nil {
 		return err
 	}
-	challenge.HasPassword = true
-	challenge.PasswordHash = string(passwordHash)
+	challenge.SetPasswordHash(passwordHash)
 	return nil
 }
 
+func (challenge *Challenge) RemovePassword() {
+	challenge.HasPassword = false
+	challenge.PasswordHash = ""
+}
+
 func (challenge *Challenge) CheckPassword(password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(challenge.PasswordHash), []byte(password))
 }
 
-func (challenge *Challenge) StorePassword(password string, w http.ResponseWriter, r *http.Request) {
-	passwordCookie := &http.Cookie{
-		Name:    challenge.CookieName(),
-		Path:    "/",
-		Value:   hex.EncodeToString([]byte(password)),
-		MaxAge:  int(time.Hour.Seconds()),
-		Expires: time.Now().Add(time.Hour),
+func (challenge *Challenge) Accessible(r *http.Request, sessions SessionStore) bool {
+	if challenge.Disabled {
+		return false
 	}
-	http.SetCookie(w, passwordCookie)
-}
 
-func (challenge *Challenge) Accessible(r *http.Request) bool {
 	if challenge.Expired() {
 		return false
 	}
 
-	if challenge.HitMaxViewCount() {
+	if challenge.NotYetValid() {
+		return false
+	}
+
+	if _, allowed := challenge.NetworkRule(requestIP(r)); !allowed {
+		return false
+	}
+
+	if challenge.HitByteQuota() {
+		return false
+	}
+
+	if challenge.HitMaxViewCount() && !challenge.ContinuesView(r) {
 		return false
 	}
 
@@ -104,30 +395,184 @@ func (challenge *Challenge) Accessible(r *http.Request) bool {
 	}
 
 	if challenge.HasPassword {
-		if cookie, _ := r.Cookie(challenge.CookieName()); cookie != nil {
-			if decoded, err := hex.DecodeString(cookie.Value); err == nil {
-				return challenge.CheckPassword(string(decoded)) == nil
+		return sessions.Unlocked(challenge, r)
+	}
+
+	return false
+}
+
+const (
+	ChallengeStatusActive    = "active"
+	ChallengeStatusScheduled = "scheduled"
+	ChallengeStatusExpired   = "expired"
+	ChallengeStatusExhausted = "exhausted"
+	ChallengeStatusPublic    = "public"
+	ChallengeStatusPassword  = "password-protected"
+	ChallengeStatusArchived  = "archived"
+)
+
+// ChallengeStatuses lists the statuses a ChallengeQuery can filter by.
+var ChallengeStatuses = []string{
+	ChallengeStatusActive,
+	ChallengeStatusScheduled,
+	ChallengeStatusExpired,
+	ChallengeStatusExhausted,
+	ChallengeStatusPublic,
+	ChallengeStatusPassword,
+	ChallengeStatusArchived,
+}
+
+// HasStatus checks one of the ChallengeStatuses. Active means the link works right now,
+// scheduled means it will once ValidFrom comes.
+func (challenge *Challenge) HasStatus(status string) bool {
+	switch status {
+	case ChallengeStatusActive:
+		return !challenge.Disabled && !challenge.Archived && !challenge.Expired() && !challenge.NotYetValid() && !challenge.HitMaxViewCount() && !challenge.HitByteQuota()
+	case ChallengeStatusScheduled:
+		return challenge.NotYetValid()
+	case ChallengeStatusExpired:
+		return challenge.Expired()
+	case ChallengeStatusExhausted:
+		return challenge.HitMaxViewCount() || challenge.HitByteQuota()
+	case ChallengeStatusPublic:
+		return challenge.Public
+	case ChallengeStatusPassword:
+		return challenge.HasPassword
+	case ChallengeStatusArchived:
+		return challenge.Archived
+	}
+	return false
+}
+
+// ChallengeQuery selects a page of challenges. Empty fields match every challenge
+// except archived ones, which are only found by asking for ChallengeStatusArchived.
+type ChallengeQuery struct {
+	Status string
+	// PathPrefix matches any shared path by whole path segments, so "/foo" matches "/foo/bar" but not "/foobar".
+	PathPrefix string
+	// Search matches ID, shared paths and Note, ignoring case.
+	Search string
+
+	Limit  int
+	Offset int
+}
+
+func (query *ChallengeQuery) Matches(challenge *Challenge) bool {
+	if challenge.Archived && query.Status != ChallengeStatusArchived {
+		return false
+	}
+	if query.Status != "" && !challenge.HasStatus(query.Status) {
+		return false
+	}
+
+	if query.PathPrefix != "" {
+		prefix := path.Clean("/" + query.PathPrefix)
+		matched := false
+		for _, sharedPath := range challenge.Paths() {
+			sharedPath = path.Clean("/" + sharedPath)
+			if sharedPath == prefix || strings.HasPrefix(sharedPath, strings.TrimSuffix(prefix, "/")+"/") {
+				matched = true
+				break
 			}
 		}
+		if !matched {
+			return false
+		}
 	}
 
-	return false
+	if query.Search != "" {
+		search := strings.ToLower(query.Search)
+		if !strings.Contains(strings.ToLower(challenge.ID), search) &&
+			!strings.Contains(strings.ToLower(challenge.DisplayPath()), search) &&
+			!strings.Contains(strings.ToLower(challenge.Note), search) {
+			return false
+		}
+	}
+
+	return true
 }
 
+var (
+	ErrChallengeNotFound           = errors.New("challenge not found")
+	ErrChallengeExpired            = errors.New("challenge expired")
+	ErrChallengeNotYetValid        = errors.New("challenge not valid yet")
+	ErrChallengeNetworkDenied      = errors.New("challenge not available from this network")
+	ErrChallengeDisabled           = errors.New("challenge disabled")
+	ErrChallengeViewLimitReached   = errors.New("challenge view limit reached")
+	ErrChallengeByteQuotaReached   = errors.New("challenge byte quota reached")
+	ErrChallengeNoUploads          = errors.New("challenge does not accept uploads")
+	ErrChallengeUploadLimitReached = errors.New("challenge upload limit reached")
+	ErrChallengeIDTaken            = errors.New("challenge ID already taken")
+)
+
+// clone returns a copy of the challenge that can be read and modified
+// without racing against the repository.
+func (challenge *Challenge) clone() *Challenge {
+	clone := *challenge
+	clone.views = append([]*ChallengeView(nil), challenge.views...)
+	clone.AllowedExtensions = append([]string(nil), challenge.AllowedExtensions...)
+	clone.AllowedNetworks = append([]string(nil), challenge.AllowedNetworks...)
+	clone.DeniedNetworks = append([]string(nil), challenge.DeniedNetworks...)
+	if challenge.SharedPaths != nil {
+		clone.SharedPaths = append([]string(nil), challenge.SharedPaths...)
+	}
+	if challenge.FileViewCounts != nil {
+		clone.FileViewCounts = make(map[string]int, len(challenge.FileViewCounts))
+		for filePath, viewCount := range challenge.FileViewCounts {
+			clone.FileViewCounts[filePath] = viewCount
+		}
+	}
+	return &clone
+}
+
+// ChallengeRepository implementations must be safe for concurrent use.
+// Challenges returned from them are copies: modify them and pass them back
+// to Set, or use Update to modify a challenge atomically.
 type ChallengeRepository interface {
 	All(limit int, offset int) []*Challenge
+	// Query returns a page of challenges matching query, and how many match in total.
+	Query(query ChallengeQuery) ([]*Challenge, int)
 	Get(ID string) *Challenge
 	Set(challenge *Challenge)
+	// Create adds a new challenge, failing with ErrChallengeIDTaken if its ID
+	// belongs to another challenge or a tombstone.
+	Create(challenge *Challenge) error
+	Update(ID string, update func(challenge *Challenge) error) (*Challenge, error)
 	Remove(challenge *Challenge)
+	// Bury removes a challenge and leaves a tombstone in its place.
+	Bury(challenge *Challenge)
+	// Tombstone returns the tombstone of a buried challenge, or nil.
+	Tombstone(ID string) *ChallengeTombstone
 	ReportChallengeView(challenge *Challenge, filePath string, request *http.Request)
+	// ReserveChallengeView records a view only if the challenge has not expired
+	// or hit its view limit, checking and recording in one step.
+	// The returned copy of the view can be passed to CompleteChallengeView.
+	ReserveChallengeView(challenge *Challenge, filePath string, request *http.Request) (*ChallengeView, error)
+	// CompleteChallengeView stores the Bytes, Status and Complete of a reserved view after it was served.
+	// Under ViewCountingDownload, this is when a complete download is counted.
+	CompleteChallengeView(challenge *Challenge, view *ChallengeView)
+	// ReserveChallengeUpload counts an upload of size bytes against the challenge's
+	// upload limits, recording it only if it fits.
+	ReserveChallengeUpload(challenge *Challenge, filePath string, size int64, request *http.Request) error
+	// ReportFailedUnlock logs a wrong password guess in the challenge's activity.
+	ReportFailedUnlock(challenge *Challenge, filePath string, request *http.Request)
+	// ReserveChallengeBytes counts up to n bytes about to be served against the
+	// challenge's byte quota, returning how many fit. A negative n gives back
+	// bytes that were reserved but couldn't be sent.
+	ReserveChallengeBytes(challenge *Challenge, n int64) int64
 }
 
 type ArrayChallengeRepository struct {
+	lock         sync.RWMutex
 	challengeIDs []string
 	challenges   map[string]*Challenge
+	tombstones   map[string]*ChallengeTombstone
 }
 
 func (repo *ArrayChallengeRepository) All(limit int, offset int) []*Challenge {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
 	challengeCount := len(repo.challengeIDs)
 
 	pageStart := offset
@@ -136,30 +581,133 @@ func (repo *ArrayChallengeRepository) All(limit int, offset int) []*Challenge {
 	if pageEnd > challengeCount {
 		pageEnd = challengeCount
 	}
+	if pageStart > pageEnd {
+		pageStart = pageEnd
+	}
 
 	challenges := make([]*Challenge, pageEnd-pageStart)
 
 	for i := range challenges {
 		challengeID := repo.challengeIDs[pageStart+i]
-		challenges[i] = repo.challenges[challengeID]
+		challenges[i] = repo.challenges[challengeID].clone()
 	}
 
 	return challenges
 }
 
+func (repo *ArrayChallengeRepository) Query(query ChallengeQuery) ([]*Challenge, int) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	challenges := []*Challenge{}
+	total := 0
+	for _, challengeID := range repo.challengeIDs {
+		challenge := repo.challenges[challengeID]
+		if !query.Matches(challenge) {
+			continue
+		}
+
+		// only clone what's on the page
+		if total >= query.Offset && len(challenges) < query.Limit {
+			challenges = append(challenges, challenge.clone())
+		}
+		total++
+	}
+
+	return challenges, total
+}
+
 func (repo *ArrayChallengeRepository) Get(ID string) *Challenge {
-	challenge, _ := repo.challenges[ID]
-	return challenge
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	challenge, exists := repo.challenges[ID]
+	if !exists {
+		return nil
+	}
+	return challenge.clone()
 }
 
-func (repo *ArrayChallengeRepository) Set(challenge *Challenge) {
+func (repo *ArrayChallengeRepository) set(challenge *Challenge) {
 	if _, exists := repo.challenges[challenge.ID]; !exists {
 		repo.challengeIDs = append(repo.challengeIDs, challenge.ID)
 	}
 	repo.challenges[challenge.ID] = challenge
 }
 
+func (repo *ArrayChallengeRepository) Set(challenge *Challenge) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.set(challenge.clone())
+}
+
+func (repo *ArrayChallengeRepository) Create(challenge *Challenge) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if _, exists := repo.challenges[challenge.ID]; exists {
+		return ErrChallengeIDTaken
+	}
+	if _, buried := repo.tombstones[challenge.ID]; buried {
+		// reusing it would bring a dead link back to life, pointing somewhere else
+		return ErrChallengeIDTaken
+	}
+
+	repo.set(challenge.clone())
+	return nil
+}
+
+func (repo *ArrayChallengeRepository) Update(ID string, update func(challenge *Challenge) error) (*Challenge, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	existing, exists := repo.challenges[ID]
+	if !exists {
+		return nil, ErrChallengeNotFound
+	}
+
+	challenge := existing.clone()
+	if err := update(challenge); err != nil {
+		return nil, err
+	}
+	challenge.ID = ID
+	repo.set(challenge)
+
+	return challenge.clone(), nil
+}
+
 func (repo *ArrayChallengeRepository) Remove(challenge *Challenge) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.remove(challenge)
+}
+
+func (repo *ArrayChallengeRepository) Bury(challenge *Challenge) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.remove(challenge)
+	repo.tombstones[challenge.ID] = &ChallengeTombstone{
+		ID:        challenge.ID,
+		RemovedAt: time.Now(),
+	}
+}
+
+func (repo *ArrayChallengeRepository) Tombstone(ID string) *ChallengeTombstone {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	tombstone, exists := repo.tombstones[ID]
+	if !exists {
+		return nil
+	}
+	copied := *tombstone
+	return &copied
+}
+
+func (repo *ArrayChallengeRepository) remove(challenge *Challenge) {
 	delete(repo.challenges, challenge.ID)
 	for i, id := range repo.challengeIDs {
 		if id == challenge.ID {
@@ -169,22 +717,191 @@ func (repo *ArrayChallengeRepository) Remove(challenge *Challenge) {
 	}
 }
 
+func newChallengeView(stored *Challenge, filePath string, request *http.Request) *ChallengeView {
+	rule, _ := stored.NetworkRule(requestIP(request))
+	offset, _, _ := requestedRange(request)
+	return &ChallengeView{
+		Time:        time.Now(),
+		IP:          request.RemoteAddr,
+		FilePath:    filePath,
+		UserAgent:   request.UserAgent(),
+		NetworkRule: rule,
+		Visitor:     visitor(request),
+		Offset:      offset,
+
+		index: len(stored.views),
+	}
+}
+
+// countView uses up a view of the share and of filePath.
+func (challenge *Challenge) countView(filePath string) {
+	challenge.ViewCount++
+	if challenge.FileViewCounts == nil {
+		challenge.FileViewCounts = make(map[string]int)
+	}
+	challenge.FileViewCounts[path.Clean("/"+filePath)]++
+}
+
+func (repo *ArrayChallengeRepository) recordView(stored *Challenge, challenge *Challenge, filePath string, request *http.Request) *ChallengeView {
+	view := newChallengeView(stored, filePath, request)
+	if stored.countsRequest(filePath, request) {
+		stored.countView(filePath)
+	} else {
+		view.Uncounted = true
+	}
+	stored.views = append(stored.views, view)
+
+	challenge.ViewCount = stored.ViewCount
+
+	copied := *view
+	return &copied
+}
+
 func (repo *ArrayChallengeRepository) ReportChallengeView(challenge *Challenge, filePath string, request *http.Request) {
-	if challenge.views == nil {
-		challenge.views = []*ChallengeView{}
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if stored, exists := repo.challenges[challenge.ID]; exists {
+		repo.recordView(stored, challenge, filePath, request)
+	}
+}
+
+func (repo *ArrayChallengeRepository) ReserveChallengeView(challenge *Challenge, filePath string, request *http.Request) (*ChallengeView, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	stored, exists := repo.challenges[challenge.ID]
+	if !exists {
+		return nil, ErrChallengeNotFound
+	}
+	if stored.Disabled {
+		return nil, ErrChallengeDisabled
+	}
+	if stored.Expired() {
+		return nil, ErrChallengeExpired
+	}
+	if stored.NotYetValid() {
+		return nil, ErrChallengeNotYetValid
+	}
+	if _, allowed := stored.NetworkRule(requestIP(request)); !allowed {
+		return nil, ErrChallengeNetworkDenied
+	}
+	if stored.RemainingViews(filePath) == 0 && !stored.continuesView(filePath, request) {
+		return nil, ErrChallengeViewLimitReached
+	}
+	if stored.HitByteQuota() {
+		return nil, ErrChallengeByteQuotaReached
+	}
+
+	return repo.recordView(stored, challenge, filePath, request), nil
+}
+
+func (repo *ArrayChallengeRepository) CompleteChallengeView(challenge *Challenge, view *ChallengeView) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	stored, exists := repo.challenges[challenge.ID]
+	if !exists || view.index >= len(stored.views) {
+		return
+	}
+
+	// views are shared with clones handed out earlier, so replace rather than modify it
+	existing := stored.views[view.index]
+	if !existing.Time.Equal(view.Time) {
+		return
+	}
+	completed := *existing
+	completed.Offset = view.Offset
+	completed.Bytes = view.Bytes
+	completed.Status = view.Status
+	completed.Complete = view.Complete
+	if completed.Uncounted && completed.Complete && stored.ViewCountingPolicy() == ViewCountingDownload && !stored.countedFor(completed.Visitor, completed.FilePath) {
+		// downloads already running when the limit is reached may still finish
+		completed.Uncounted = false
+		stored.countView(completed.FilePath)
+	}
+	stored.views[view.index] = &completed
+}
+
+func (repo *ArrayChallengeRepository) ReserveChallengeBytes(challenge *Challenge, n int64) int64 {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	stored, exists := repo.challenges[challenge.ID]
+	if !exists {
+		return 0
+	}
+	if remaining := stored.RemainingServedBytes(); remaining >= 0 && n > remaining {
+		n = remaining
+	}
+	if stored.ServedBytes+n < 0 {
+		n = -stored.ServedBytes
+	}
+	stored.ServedBytes += n
+	return n
+}
+
+func (repo *ArrayChallengeRepository) ReserveChallengeUpload(challenge *Challenge, filePath string, size int64, request *http.Request) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	stored, exists := repo.challenges[challenge.ID]
+	if !exists {
+		return ErrChallengeNotFound
+	}
+	if !stored.AcceptsUploads {
+		return ErrChallengeNoUploads
+	}
+	if stored.Disabled {
+		return ErrChallengeDisabled
+	}
+	if stored.Expired() {
+		return ErrChallengeExpired
+	}
+	if stored.NotYetValid() {
+		return ErrChallengeNotYetValid
+	}
+	if _, allowed := stored.NetworkRule(requestIP(request)); !allowed {
+		return ErrChallengeNetworkDenied
+	}
+	if remaining := stored.RemainingUploadBytes(); remaining >= 0 && size > remaining {
+		return ErrChallengeUploadLimitReached
+	}
+	if stored.RemainingUploadFiles() == 0 {
+		return ErrChallengeUploadLimitReached
+	}
+
+	view := newChallengeView(stored, filePath, request)
+	view.Upload = true
+	view.Bytes = size
+	stored.views = append(stored.views, view)
+	stored.UploadedBytes += size
+	stored.UploadedFiles++
+
+	challenge.UploadedBytes = stored.UploadedBytes
+	challenge.UploadedFiles = stored.UploadedFiles
+	return nil
+}
+
+func (repo *ArrayChallengeRepository) ReportFailedUnlock(challenge *Challenge, filePath string, request *http.Request) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	stored, exists := repo.challenges[challenge.ID]
+	if !exists {
+		return
 	}
 
-	challenge.views = append(challenge.views, &ChallengeView{
-		Time: time.Now(),
-		IP:   request.RemoteAddr,
-	})
-	challenge.ViewCount = len(challenge.views)
-	repo.Set(challenge)
+	view := newChallengeView(stored, filePath, request)
+	view.FailedUnlock = true
+	view.Status = http.StatusUnauthorized
+	stored.views = append(stored.views, view)
 }
 
 func NewArrayChallengeRepository() ChallengeRepository {
 	return &ArrayChallengeRepository{
 		challengeIDs: []string{},
 		challenges:   make(map[string]*Challenge),
+		tombstones:   make(map[string]*ChallengeTombstone),
 	}
 }
@@ -0,0 +1,411 @@
+package stuff
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReserveChallengeViewEnforcesLimitConcurrently(t *testing.T) {
+	repo := NewArrayChallengeRepository()
+
+	challenge := &Challenge{ID: "foo", Public: true}
+	challenge.SetMaxViewCount(1)
+	repo.Set(challenge)
+
+	var wg sync.WaitGroup
+	var reserved sync.Map
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request := httptest.NewRequest("GET", "/view/foo/bar", nil)
+			if _, err := repo.ReserveChallengeView(repo.Get("foo"), "/bar", request); err == nil {
+				reserved.Store(i, true)
+			} else if err != ErrChallengeViewLimitReached {
+				t.Errorf("unexpected error %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	count := 0
+	reserved.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+	if count != 1 {
+		t.Errorf("expected exactly 1 reserved view but got %d", count)
+	}
+
+	if actual := repo.Get("foo").ViewCount; actual != 1 {
+		t.Errorf("expected view count 1 but got %d", actual)
+	}
+}
+
+func TestArrayChallengeRepositoryConcurrentUse(t *testing.T) {
+	repo := NewArrayChallengeRepository()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			challenge := &Challenge{ID: fmt.Sprintf("challenge-%d", i), Public: true}
+			repo.Set(challenge)
+
+			request := httptest.NewRequest("GET", "/view/"+challenge.ID, nil)
+			for j := 0; j < 10; j++ {
+				repo.ReportChallengeView(repo.Get(challenge.ID), "/", request)
+				repo.All(10, 0)
+			}
+
+			if _, err := repo.Update(challenge.ID, func(challenge *Challenge) error {
+				challenge.Public = false
+				return nil
+			}); err != nil {
+				t.Error(err)
+			}
+
+			if i%2 == 0 {
+				repo.Remove(challenge)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, challenge := range repo.All(100, 0) {
+		if challenge.ViewCount != 10 || len(challenge.Views()) != 10 {
+			t.Errorf("expected 10 views on %s but got %d", challenge.ID, challenge.ViewCount)
+		}
+		if challenge.Public {
+			t.Errorf("expected %s to be updated", challenge.ID)
+		}
+	}
+	if actual := len(repo.All(100, 0)); actual != 10 {
+		t.Errorf("expected 10 remaining challenges but got %d", actual)
+	}
+}
+
+func TestReserveChallengeUploadEnforcesLimits(t *testing.T) {
+	repo := NewArrayChallengeRepository()
+	repo.Set(&Challenge{ID: "foo", AcceptsUploads: true, MaxUploadBytes: 100, MaxUploadFiles: 2})
+
+	request := httptest.NewRequest("POST", "/view/foo", nil)
+	if err := repo.ReserveChallengeUpload(repo.Get("foo"), "/a.txt", 60, request); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ReserveChallengeUpload(repo.Get("foo"), "/b.txt", 60, request); err != ErrChallengeUploadLimitReached {
+		t.Errorf("expected upload over the byte limit to fail but got %v", err)
+	}
+	if err := repo.ReserveChallengeUpload(repo.Get("foo"), "/c.txt", 40, request); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ReserveChallengeUpload(repo.Get("foo"), "/d.txt", 0, request); err != ErrChallengeUploadLimitReached {
+		t.Errorf("expected upload over the file limit to fail but got %v", err)
+	}
+
+	challenge := repo.Get("foo")
+	if challenge.UploadedBytes != 100 || challenge.UploadedFiles != 2 || len(challenge.Views()) != 2 {
+		t.Errorf("expected 2 uploads of 100 bytes but got %d of %d bytes", challenge.UploadedFiles, challenge.UploadedBytes)
+	}
+	if !challenge.Views()[0].Upload || challenge.Views()[0].FilePath != "/a.txt" {
+		t.Errorf("expected upload of /a.txt to be logged but got %+v", challenge.Views()[0])
+	}
+}
+
+func TestCompleteChallengeViewRecordsResponse(t *testing.T) {
+	repo := NewArrayChallengeRepository()
+	repo.Set(&Challenge{ID: "foo", Public: true})
+
+	request := httptest.NewRequest("GET", "/view/foo/bar", nil)
+	request.Header.Set("User-Agent", "curl/8.0")
+
+	view, err := repo.ReserveChallengeView(repo.Get("foo"), "/bar", request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := repo.Get("foo")
+	view.Bytes = 42
+	view.Status = 206
+	repo.CompleteChallengeView(repo.Get("foo"), view)
+
+	actual := repo.Get("foo").Views()[0]
+	if actual.FilePath != "/bar" || actual.UserAgent != "curl/8.0" || actual.Bytes != 42 || actual.Status != 206 {
+		t.Errorf("unexpected completed view %+v", actual)
+	}
+	if before.Views()[0].Bytes != 0 {
+		t.Error("expected copies handed out earlier not to change")
+	}
+}
+
+func TestQueryFiltersAndPages(t *testing.T) {
+	repo := NewArrayChallengeRepository()
+	for i := 0; i < 5; i++ {
+		repo.Set(&Challenge{ID: fmt.Sprintf("public-%d", i), Public: true, SharedPath: "/photos/2024"})
+	}
+	repo.Set(&Challenge{ID: "exhausted", Public: true, SharedPath: "/photos", HasViewCountLimit: true, MaxViewCount: 1, ViewCount: 1})
+	repo.Set(&Challenge{ID: "other", SharedPath: "/photosynthesis", Note: "For Alice"})
+
+	challenges, total := repo.Query(ChallengeQuery{Status: ChallengeStatusPublic, Limit: 2, Offset: 2})
+	if total != 6 || len(challenges) != 2 || challenges[0].ID != "public-2" {
+		t.Errorf("expected page 2 of 6 public challenges but got %d of %d", len(challenges), total)
+	}
+
+	if _, total := repo.Query(ChallengeQuery{Status: ChallengeStatusExhausted, Limit: 10}); total != 1 {
+		t.Errorf("expected 1 exhausted challenge but got %d", total)
+	}
+	if _, total := repo.Query(ChallengeQuery{PathPrefix: "/photos", Limit: 10}); total != 6 {
+		t.Errorf("expected path prefix to match whole segments but got %d", total)
+	}
+	if challenges, _ := repo.Query(ChallengeQuery{Search: "alice", Limit: 10}); len(challenges) != 1 || challenges[0].ID != "other" {
+		t.Errorf("expected search to match note but got %d challenges", len(challenges))
+	}
+}
+
+func TestSharedEntriesNumbersClashes(t *testing.T) {
+	challenge := &Challenge{SharedPaths: []string{"/a/notes.txt", "/b/notes.txt", "/c/photos", "/d/photos", "/"}}
+
+	var names []string
+	for _, entry := range challenge.SharedEntries() {
+		names = append(names, entry.Name)
+	}
+	expected := []string{"notes.txt", "notes (2).txt", "photos", "photos (2)", "files"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected entries %v but got %v", expected, names)
+	}
+
+	repo := NewArrayChallengeRepository()
+	repo.Set(&Challenge{ID: "multi", SharedPaths: []string{"/music", "/photos/2024"}})
+	if _, total := repo.Query(ChallengeQuery{PathPrefix: "/photos", Limit: 10}); total != 1 {
+		t.Errorf("expected path prefix to match any shared path but got %d", total)
+	}
+}
+
+func TestValidFromKeepsChallengeClosedUntilThen(t *testing.T) {
+	repo := NewArrayChallengeRepository()
+	challenge := &Challenge{ID: "embargoed", Public: true}
+	challenge.SetValidFrom(time.Now().Add(time.Hour))
+	repo.Set(challenge)
+
+	if challenge.Accessible(httptest.NewRequest("GET", "/", nil), nil) {
+		t.Error("expected challenge to be closed before valid from")
+	}
+	if !challenge.HasStatus(ChallengeStatusScheduled) || challenge.HasStatus(ChallengeStatusActive) {
+		t.Error("expected challenge to be scheduled rather than active")
+	}
+	if _, err := repo.ReserveChallengeView(challenge, "/", httptest.NewRequest("GET", "/", nil)); err != ErrChallengeNotYetValid {
+		t.Errorf("expected ErrChallengeNotYetValid but got %v", err)
+	}
+
+	challenge.SetValidFrom(time.Now().Add(-time.Minute))
+	repo.Set(challenge)
+	if !challenge.Accessible(httptest.NewRequest("GET", "/", nil), nil) {
+		t.Error("expected challenge to open after valid from")
+	}
+	if _, err := repo.ReserveChallengeView(challenge, "/", httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Errorf("expected view to be reserved but got %v", err)
+	}
+}
+
+func TestReserveChallengeBytesStopsAtQuota(t *testing.T) {
+	repo := NewArrayChallengeRepository()
+	challenge := &Challenge{ID: "quota", Public: true, MaxServedBytes: 100}
+	repo.Set(challenge)
+
+	if granted := repo.ReserveChallengeBytes(challenge, 60); granted != 60 {
+		t.Errorf("expected 60 bytes but got %d", granted)
+	}
+	if granted := repo.ReserveChallengeBytes(challenge, 60); granted != 40 {
+		t.Errorf("expected the last 40 bytes but got %d", granted)
+	}
+	if stored := repo.Get("quota"); !stored.HitByteQuota() || stored.HasStatus(ChallengeStatusActive) {
+		t.Error("expected challenge to be exhausted once its quota is used up")
+	}
+	if _, err := repo.ReserveChallengeView(challenge, "/", httptest.NewRequest("GET", "/", nil)); err != ErrChallengeByteQuotaReached {
+		t.Errorf("expected ErrChallengeByteQuotaReached but got %v", err)
+	}
+
+	repo.ReserveChallengeBytes(challenge, -30)
+	if stored := repo.Get("quota"); stored.RemainingServedBytes() != 30 {
+		t.Errorf("expected 30 bytes back but %d remain", stored.RemainingServedBytes())
+	}
+}
+
+func TestViewCountingPolicies(t *testing.T) {
+	viewerRequest := func(visitor string, ranges string) *http.Request {
+		request := httptest.NewRequest("GET", "/view/foo/video.mp4", nil)
+		request.AddCookie(&http.Cookie{Name: VisitorCookieName, Value: visitor})
+		if ranges != "" {
+			request.Header.Set("Range", ranges)
+		}
+		return request
+	}
+
+	t.Run("request", func(t *testing.T) {
+		repo := NewArrayChallengeRepository()
+		challenge := &Challenge{ID: "foo", Public: true}
+		challenge.SetMaxViewCount(1)
+		repo.Set(challenge)
+
+		first, err := repo.ReserveChallengeView(challenge, "/video.mp4", viewerRequest("a", "bytes=0-"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the player stopped after the first 1000 bytes
+		first.Status, first.Bytes = http.StatusPartialContent, 1000
+		repo.CompleteChallengeView(challenge, first)
+		// seeking past what was sent in the last view is still allowed, and free
+		view, err := repo.ReserveChallengeView(challenge, "/video.mp4", viewerRequest("a", "bytes=1000-"))
+		if err != nil || !view.Uncounted {
+			t.Errorf("expected a free range continuation but got %+v, %v", view, err)
+		}
+		if _, err := repo.ReserveChallengeView(challenge, "/video.mp4", viewerRequest("b", "bytes=1000-")); err != ErrChallengeViewLimitReached {
+			t.Errorf("expected other visitors to be refused but got %v", err)
+		}
+		if _, err := repo.ReserveChallengeView(challenge, "/video.mp4", viewerRequest("a", "")); err != ErrChallengeViewLimitReached {
+			t.Errorf("expected repeats to be refused but got %v", err)
+		}
+		// these could add up to the whole file again
+		for _, ranges := range []string{"bytes=500-,0-499", "bytes=-500", "bytes=0-", "bytes=00-"} {
+			if _, err := repo.ReserveChallengeView(challenge, "/video.mp4", viewerRequest("a", ranges)); err != ErrChallengeViewLimitReached {
+				t.Errorf("expected %q to be refused but got %v", ranges, err)
+			}
+		}
+		if _, err := repo.ReserveChallengeView(challenge, "/other.mp4", viewerRequest("a", "bytes=1000-")); err != ErrChallengeViewLimitReached {
+			t.Errorf("expected continuations of other files to be refused but got %v", err)
+		}
+		if actual := repo.Get("foo").ViewCount; actual != 1 {
+			t.Errorf("expected view count 1 but got %d", actual)
+		}
+	})
+
+	t.Run("request, repeating ranges", func(t *testing.T) {
+		repo := NewArrayChallengeRepository()
+		challenge := &Challenge{ID: "foo", Public: true}
+		challenge.SetMaxViewCount(1)
+		repo.Set(challenge)
+
+		view, err := repo.ReserveChallengeView(challenge, "/video.mp4", viewerRequest("a", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		view.Status, view.Bytes, view.Complete = http.StatusOK, 5000, true
+		repo.CompleteChallengeView(challenge, view)
+
+		// almost the whole file again, which was already sent
+		for i := 0; i < 5; i++ {
+			if _, err := repo.ReserveChallengeView(challenge, "/video.mp4", viewerRequest("a", "bytes=1-")); err != ErrChallengeViewLimitReached {
+				t.Errorf("expected repeated bytes=1- to be refused but got %v", err)
+			}
+		}
+		if actual := repo.Get("foo").ViewCount; actual != 1 {
+			t.Errorf("expected view count 1 but got %d", actual)
+		}
+
+		// with a view left, going back over sent bytes uses it up
+		challenge.SetMaxViewCount(3)
+		repo.Set(challenge)
+		partial, err := repo.ReserveChallengeView(challenge, "/video.mp4", viewerRequest("b", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		partial.Status, partial.Bytes = http.StatusOK, 100
+		repo.CompleteChallengeView(challenge, partial)
+		continued, err := repo.ReserveChallengeView(challenge, "/video.mp4", viewerRequest("b", "bytes=100-199"))
+		if err != nil || !continued.Uncounted {
+			t.Fatalf("expected a free range continuation but got %+v, %v", continued, err)
+		}
+		continued.Status, continued.Bytes = http.StatusPartialContent, 100
+		repo.CompleteChallengeView(challenge, continued)
+		// still being sent, so all of it counts as sent
+		if continued, err = repo.ReserveChallengeView(challenge, "/video.mp4", viewerRequest("b", "bytes=200-")); err != nil || !continued.Uncounted {
+			t.Fatalf("expected a free range continuation but got %+v, %v", continued, err)
+		}
+		if continued, err = repo.ReserveChallengeView(challenge, "/video.mp4", viewerRequest("b", "bytes=150-")); err != nil || continued.Uncounted {
+			t.Fatalf("expected going back to count but got %+v, %v", continued, err)
+		}
+		if actual := repo.Get("foo").ViewCount; actual != 3 {
+			t.Errorf("expected only going back to count, for 3 views, but got %d", actual)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		repo := NewArrayChallengeRepository()
+		challenge := &Challenge{ID: "foo", Public: true, ViewCounting: ViewCountingFile}
+		challenge.SetMaxViewCount(2)
+		repo.Set(challenge)
+
+		for _, visitor := range []string{"a", "a", "b", "a"} {
+			if _, err := repo.ReserveChallengeView(challenge, "/video.mp4", viewerRequest(visitor, "")); err != nil {
+				t.Fatalf("visitor %v: %v", visitor, err)
+			}
+		}
+		if actual := repo.Get("foo").ViewCount; actual != 2 {
+			t.Errorf("expected view count 2 but got %d", actual)
+		}
+		if _, err := repo.ReserveChallengeView(challenge, "/video.mp4", viewerRequest("c", "")); err != ErrChallengeViewLimitReached {
+			t.Errorf("expected new visitors to be refused but got %v", err)
+		}
+	})
+
+	t.Run("download", func(t *testing.T) {
+		repo := NewArrayChallengeRepository()
+		challenge := &Challenge{ID: "foo", Public: true, ViewCounting: ViewCountingDownload}
+		challenge.SetMaxViewCount(5)
+		repo.Set(challenge)
+
+		for _, complete := range []bool{false, true, true} {
+			view, err := repo.ReserveChallengeView(challenge, "/video.mp4", viewerRequest("a", ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			view.Complete = complete
+			repo.CompleteChallengeView(challenge, view)
+		}
+		if actual := repo.Get("foo").ViewCount; actual != 1 {
+			t.Errorf("expected only the first complete download to count but got %d views", actual)
+		}
+	})
+}
+
+func TestViewLimitPerFile(t *testing.T) {
+	repo := NewArrayChallengeRepository()
+	challenge := &Challenge{ID: "foo", Public: true, ViewLimitPerFile: true}
+	challenge.SetMaxViewCount(1)
+	repo.Set(challenge)
+
+	for _, filePath := range []string{"/a.txt", "/b.txt"} {
+		if _, err := repo.ReserveChallengeView(challenge, filePath, httptest.NewRequest("GET", "/", nil)); err != nil {
+			t.Fatalf("%v: %v", filePath, err)
+		}
+	}
+	if _, err := repo.ReserveChallengeView(challenge, "/a.txt", httptest.NewRequest("GET", "/", nil)); err != ErrChallengeViewLimitReached {
+		t.Errorf("expected ErrChallengeViewLimitReached but got %v", err)
+	}
+
+	stored := repo.Get("foo")
+	if stored.HitMaxViewCount() || !stored.HasStatus(ChallengeStatusActive) {
+		t.Error("expected the share to stay active while only some files are used up")
+	}
+	if remaining := stored.RemainingViews("a.txt"); remaining != 0 {
+		t.Errorf("expected no views of a.txt left but got %d", remaining)
+	}
+	if remaining := stored.RemainingViews("/c.txt"); remaining != 1 {
+		t.Errorf("expected 1 view of c.txt left but got %d", remaining)
+	}
+
+	fileViews := stored.FileViews()
+	if len(fileViews) != 2 || fileViews[0] != (FileViews{FilePath: "/a.txt", ViewCount: 1, RemainingViews: 0}) || fileViews[1].FilePath != "/b.txt" {
+		t.Errorf("unexpected file views %+v", fileViews)
+	}
+
+	stored.ResetViewCount()
+	if remaining := stored.RemainingViews("/a.txt"); remaining != 1 || repo.Get("foo").RemainingViews("/a.txt") != 0 {
+		t.Error("expected resetting a copy to only reset the copy")
+	}
+}
@@ -0,0 +1,215 @@
+package stuff
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path"
+)
+
+// challengeLogCompactAfter is how many views are appended to the log
+// before they are folded into a new snapshot of the challenges file.
+const challengeLogCompactAfter = 1000
+
+// challengeLogEntry records a view as it stands after a change, along with the
+// challenge's counters at that time. Replaying an entry twice does no harm.
+type challengeLogEntry struct {
+	ID    string
+	Index int
+	View  *ChallengeView
+
+	ViewCount     int
+	FileViewCount int   `json:",omitempty"`
+	UploadedBytes int64 `json:",omitempty"`
+	UploadedFiles int   `json:",omitempty"`
+	ServedBytes   int64 `json:",omitempty"`
+}
+
+func (repo *FileChallengeRepository) logPath() string {
+	return repo.path + ".log"
+}
+
+// logged runs change like locked, then appends the view at the index it returns
+// to the log instead of saving everything. -1 means nothing changed.
+func (repo *FileChallengeRepository) logged(challengeID string, change func() int) {
+	repo.locked(func() bool {
+		index := change()
+		if index < 0 {
+			return false
+		}
+		if err := repo.appendLog(challengeID, index); err != nil {
+			log.Printf("Error appending to %v, saving everything instead: %v", repo.logPath(), err)
+			return true
+		}
+		return repo.logEntries >= challengeLogCompactAfter
+	})
+}
+
+// loggedAppend is logged for changes that may add a view to the end.
+func (repo *FileChallengeRepository) loggedAppend(challengeID string, change func()) {
+	repo.logged(challengeID, func() int {
+		before := repo.viewsLen(challengeID)
+		change()
+		if repo.viewsLen(challengeID) == before {
+			return -1
+		}
+		return before
+	})
+}
+
+func (repo *FileChallengeRepository) viewsLen(challengeID string) int {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	if stored, exists := repo.challenges[challengeID]; exists {
+		return len(stored.views)
+	}
+	return 0
+}
+
+// appendLog writes the view at index of challengeID to the end of the log.
+// The file must be locked.
+func (repo *FileChallengeRepository) appendLog(challengeID string, index int) error {
+	repo.unsavedLock.Lock()
+	defer repo.unsavedLock.Unlock()
+
+	repo.lock.RLock()
+	stored, exists := repo.challenges[challengeID]
+	if !exists || index >= len(stored.views) {
+		repo.lock.RUnlock()
+		return nil
+	}
+	view := stored.views[index]
+	entry := &challengeLogEntry{
+		ID:    challengeID,
+		Index: index,
+		View:  view,
+
+		ViewCount:     stored.ViewCount,
+		FileViewCount: stored.FileViewCounts[path.Clean("/"+view.FilePath)],
+		UploadedBytes: stored.UploadedBytes,
+		UploadedFiles: stored.UploadedFiles,
+		ServedBytes:   stored.ServedBytes,
+	}
+	line, err := json.Marshal(entry)
+	repo.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// not synced like snapshots are, a crashing machine may lose the last few views
+	file, err := os.OpenFile(repo.logPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// don't leave half a line for the next entry to be appended to
+		os.Truncate(repo.logPath(), repo.logOffset)
+		return err
+	}
+	repo.logOffset += int64(n)
+
+	repo.logEntries++
+	delete(repo.unsavedBytes, challengeID)
+	return nil
+}
+
+// replayLog applies entries other processes appended to the log since we last read it.
+// The file and unsavedLock must be locked.
+func (repo *FileChallengeRepository) replayLog() {
+	file, err := os.Open(repo.logPath())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error opening %v: %v", repo.logPath(), err)
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		log.Printf("Error stat'ing %v: %v", repo.logPath(), err)
+		return
+	}
+	if stat.Size() < repo.logOffset {
+		// emptied by a save, entries are safe to apply again
+		repo.logOffset = 0
+	}
+	if stat.Size() == repo.logOffset {
+		return
+	}
+
+	contents := make([]byte, stat.Size()-repo.logOffset)
+	if _, err := file.ReadAt(contents, repo.logOffset); err != nil && err != io.EOF {
+		log.Printf("Error reading %v: %v", repo.logPath(), err)
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	read := 0
+	for {
+		end := bytes.IndexByte(contents[read:], '\n')
+		if end < 0 {
+			break
+		}
+		line := contents[read : read+end]
+		read += end + 1
+
+		var entry challengeLogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("Skipping broken entry in %v: %v", repo.logPath(), err)
+			continue
+		}
+		repo.applyLogEntry(&entry)
+		repo.logEntries++
+	}
+	repo.logOffset += int64(read)
+
+	if read < len(contents) {
+		// only a writer that crashed leaves half a line, since we hold the lock
+		if err := os.Truncate(repo.logPath(), repo.logOffset); err != nil {
+			log.Printf("Error truncating half-written entry of %v: %v", repo.logPath(), err)
+		}
+	}
+}
+
+// applyLogEntry puts the view of entry in place, with the counters it was logged with.
+// repo.lock must be held.
+func (repo *FileChallengeRepository) applyLogEntry(entry *challengeLogEntry) {
+	stored, exists := repo.challenges[entry.ID]
+	if !exists || entry.View == nil {
+		return
+	}
+
+	view := entry.View
+	view.index = entry.Index
+	switch {
+	case entry.Index < len(stored.views):
+		stored.views[entry.Index] = view
+	case entry.Index == len(stored.views):
+		stored.views = append(stored.views, view)
+	default:
+		log.Printf("Skipping view %d of challenge %v in %v, views before it are missing", entry.Index, entry.ID, repo.logPath())
+		return
+	}
+
+	stored.ViewCount = entry.ViewCount
+	if entry.FileViewCount > 0 {
+		if stored.FileViewCounts == nil {
+			stored.FileViewCounts = make(map[string]int)
+		}
+		stored.FileViewCounts[path.Clean("/"+view.FilePath)] = entry.FileViewCount
+	}
+	stored.UploadedBytes = entry.UploadedBytes
+	stored.UploadedFiles = entry.UploadedFiles
+	stored.ServedBytes = entry.ServedBytes + repo.unsavedBytes[entry.ID]
+}
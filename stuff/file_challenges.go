@@ -0,0 +1,380 @@
+package stuff
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FileChallengeRepository keeps challenges in memory like ArrayChallengeRepository,
+// but writes them to a JSON file so shares survive restarts. Views, which happen
+// far more often than other changes, are appended to a log next to the file
+// instead, and only folded into the file every so often.
+//
+// Several processes (the server and the share subcommands) may use the same files.
+// Each change locks them, catches up with other processes' changes, and writes
+// its own before unlocking, so no process overwrites another's changes.
+type FileChallengeRepository struct {
+	ArrayChallengeRepository
+
+	// saveLock serializes reads and writes of the file within this process,
+	// lockFile (flock) across processes
+	saveLock sync.Mutex
+	lockFile *os.File
+	path     string
+
+	// the file as of our last load or save, to notice changes by other processes.
+	// Saves replace the file, so it is a different file after each one.
+	seen os.FileInfo
+	// logOffset is how much of the log has been applied,
+	// logEntries how many entries it had then
+	logOffset  int64
+	logEntries int
+
+	// unsavedBytes counts ServedBytes since the last save by challenge ID,
+	// so they can be added back when another process's changes are loaded
+	unsavedLock  sync.Mutex
+	unsavedBytes map[string]int64
+}
+
+type challengeRecord struct {
+	Challenge
+	Views []*ChallengeView
+}
+
+type challengeFile struct {
+	Challenges []*challengeRecord
+	Tombstones []*ChallengeTombstone `json:",omitempty"`
+}
+
+func (repo *FileChallengeRepository) load() error {
+	contents, err := os.ReadFile(repo.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var file challengeFile
+	if err := json.Unmarshal(contents, &file); err != nil {
+		return err
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.challengeIDs = []string{}
+	repo.challenges = make(map[string]*Challenge)
+	for _, record := range file.Challenges {
+		challenge := record.Challenge
+		challenge.views = record.Views
+		repo.set(&challenge)
+	}
+	repo.tombstones = make(map[string]*ChallengeTombstone)
+	for _, tombstone := range file.Tombstones {
+		repo.tombstones[tombstone.ID] = tombstone
+	}
+
+	return nil
+}
+
+func (repo *FileChallengeRepository) remember(stat os.FileInfo) {
+	repo.seen = stat
+}
+
+// locked runs change with the file locked and up to date, saving it afterwards
+// if change returns true.
+func (repo *FileChallengeRepository) locked(change func() bool) {
+	repo.saveLock.Lock()
+	defer repo.saveLock.Unlock()
+
+	if err := lockFile(repo.lockFile); err != nil {
+		log.Printf("Error locking %v: %v", repo.lockFile.Name(), err)
+	} else {
+		defer unlockFile(repo.lockFile)
+	}
+
+	repo.refreshLocked()
+	if change() {
+		repo.saveLocked()
+	}
+}
+
+// refresh reloads the file if another process changed it since we last saw it.
+func (repo *FileChallengeRepository) refresh() {
+	repo.locked(func() bool { return false })
+}
+
+func (repo *FileChallengeRepository) refreshLocked() {
+	repo.unsavedLock.Lock()
+	defer repo.unsavedLock.Unlock()
+
+	if stat, err := os.Stat(repo.path); err == nil && !repo.sawFile(stat) {
+		if err := repo.load(); err != nil {
+			log.Printf("Error reloading challenges from %v: %v", repo.path, err)
+			return
+		}
+		repo.remember(stat)
+		// whatever is in the log now was written after this snapshot
+		repo.logOffset = 0
+		repo.logEntries = 0
+
+		// the other process didn't know about downloads since our last save
+		repo.lock.Lock()
+		for challengeID, n := range repo.unsavedBytes {
+			if stored, exists := repo.challenges[challengeID]; exists {
+				stored.ServedBytes += n
+			}
+		}
+		repo.lock.Unlock()
+	}
+
+	repo.replayLog()
+}
+
+func (repo *FileChallengeRepository) sawFile(stat os.FileInfo) bool {
+	return repo.seen != nil && os.SameFile(stat, repo.seen) && stat.ModTime().Equal(repo.seen.ModTime()) && stat.Size() == repo.seen.Size()
+}
+
+func (repo *FileChallengeRepository) snapshot() *challengeFile {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	file := &challengeFile{
+		Challenges: make([]*challengeRecord, len(repo.challengeIDs)),
+	}
+	for i, challengeID := range repo.challengeIDs {
+		challenge := repo.challenges[challengeID].clone()
+		file.Challenges[i] = &challengeRecord{
+			Challenge: *challenge,
+			Views:     challenge.views,
+		}
+	}
+	for _, tombstone := range repo.tombstones {
+		copied := *tombstone
+		file.Tombstones = append(file.Tombstones, &copied)
+	}
+	sort.Slice(file.Tombstones, func(i, j int) bool { return file.Tombstones[i].RemovedAt.Before(file.Tombstones[j].RemovedAt) })
+
+	return file
+}
+
+func (repo *FileChallengeRepository) saveLocked() {
+	repo.unsavedLock.Lock()
+	snapshot := repo.snapshot()
+	unsavedBytes := repo.unsavedBytes
+	repo.unsavedBytes = make(map[string]int64)
+	repo.unsavedLock.Unlock()
+
+	if err := writeFileAtomic(repo.path, snapshot); err != nil {
+		log.Printf("Error saving challenges to %v: %v", repo.path, err)
+		// still unsaved then
+		repo.unsavedLock.Lock()
+		for challengeID, n := range unsavedBytes {
+			repo.unsavedBytes[challengeID] += n
+		}
+		repo.unsavedLock.Unlock()
+		return
+	}
+
+	if stat, err := os.Stat(repo.path); err == nil {
+		repo.remember(stat)
+	}
+
+	// the snapshot has everything that was logged
+	if err := os.Truncate(repo.logPath(), 0); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error emptying %v: %v", repo.logPath(), err)
+	}
+	repo.logOffset = 0
+	repo.logEntries = 0
+}
+
+// writeFileAtomic writes v as JSON to a temporary file next to path and renames
+// it into place, so a crash mid-write never leaves a truncated file behind.
+func writeFileAtomic(path string, v interface{}) error {
+	contents, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (repo *FileChallengeRepository) All(limit int, offset int) []*Challenge {
+	repo.refresh()
+	return repo.ArrayChallengeRepository.All(limit, offset)
+}
+
+func (repo *FileChallengeRepository) Query(query ChallengeQuery) ([]*Challenge, int) {
+	repo.refresh()
+	return repo.ArrayChallengeRepository.Query(query)
+}
+
+func (repo *FileChallengeRepository) Get(ID string) *Challenge {
+	repo.refresh()
+	return repo.ArrayChallengeRepository.Get(ID)
+}
+
+func (repo *FileChallengeRepository) Set(challenge *Challenge) {
+	repo.locked(func() bool {
+		repo.ArrayChallengeRepository.Set(challenge)
+		return true
+	})
+}
+
+func (repo *FileChallengeRepository) Create(challenge *Challenge) (err error) {
+	repo.locked(func() bool {
+		err = repo.ArrayChallengeRepository.Create(challenge)
+		return err == nil
+	})
+	return err
+}
+
+func (repo *FileChallengeRepository) Update(ID string, update func(challenge *Challenge) error) (challenge *Challenge, err error) {
+	repo.locked(func() bool {
+		challenge, err = repo.ArrayChallengeRepository.Update(ID, update)
+		return err == nil
+	})
+	return challenge, err
+}
+
+func (repo *FileChallengeRepository) Remove(challenge *Challenge) {
+	repo.locked(func() bool {
+		repo.ArrayChallengeRepository.Remove(challenge)
+		return true
+	})
+}
+
+func (repo *FileChallengeRepository) Bury(challenge *Challenge) {
+	repo.locked(func() bool {
+		repo.ArrayChallengeRepository.Bury(challenge)
+		return true
+	})
+}
+
+func (repo *FileChallengeRepository) Tombstone(ID string) *ChallengeTombstone {
+	repo.refresh()
+	return repo.ArrayChallengeRepository.Tombstone(ID)
+}
+
+func (repo *FileChallengeRepository) ReportChallengeView(challenge *Challenge, filePath string, request *http.Request) {
+	repo.loggedAppend(challenge.ID, func() {
+		repo.ArrayChallengeRepository.ReportChallengeView(challenge, filePath, request)
+	})
+}
+
+func (repo *FileChallengeRepository) ReserveChallengeView(challenge *Challenge, filePath string, request *http.Request) (view *ChallengeView, err error) {
+	repo.loggedAppend(challenge.ID, func() {
+		view, err = repo.ArrayChallengeRepository.ReserveChallengeView(challenge, filePath, request)
+	})
+	return view, err
+}
+
+func (repo *FileChallengeRepository) CompleteChallengeView(challenge *Challenge, view *ChallengeView) {
+	repo.logged(challenge.ID, func() int {
+		repo.ArrayChallengeRepository.CompleteChallengeView(challenge, view)
+		return view.index
+	})
+}
+
+func (repo *FileChallengeRepository) ReserveChallengeUpload(challenge *Challenge, filePath string, size int64, request *http.Request) (err error) {
+	repo.loggedAppend(challenge.ID, func() {
+		err = repo.ArrayChallengeRepository.ReserveChallengeUpload(challenge, filePath, size, request)
+	})
+	return err
+}
+
+func (repo *FileChallengeRepository) ReportFailedUnlock(challenge *Challenge, filePath string, request *http.Request) {
+	repo.loggedAppend(challenge.ID, func() {
+		repo.ArrayChallengeRepository.ReportFailedUnlock(challenge, filePath, request)
+	})
+}
+
+// ReserveChallengeBytes is called for every write of a download, so it only
+// counts in memory. The next write of the challenge, at the latest
+// CompleteChallengeView once the download ends, saves the total.
+func (repo *FileChallengeRepository) ReserveChallengeBytes(challenge *Challenge, n int64) int64 {
+	repo.unsavedLock.Lock()
+	defer repo.unsavedLock.Unlock()
+
+	n = repo.ArrayChallengeRepository.ReserveChallengeBytes(challenge, n)
+	repo.unsavedBytes[challenge.ID] += n
+	return n
+}
+
+// NewFileChallengeRepository loads challenges from the JSON file at path and the
+// views logged next to it, creating its parent directory if needed.
+// A missing file is treated as empty.
+func NewFileChallengeRepository(path string) (ChallengeRepository, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	repo := &FileChallengeRepository{
+		ArrayChallengeRepository: ArrayChallengeRepository{
+			challengeIDs: []string{},
+			challenges:   make(map[string]*Challenge),
+			tombstones:   make(map[string]*ChallengeTombstone),
+		},
+		path:         path,
+		unsavedBytes: make(map[string]int64),
+	}
+
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	repo.lockFile = lock
+
+	if err := repo.loadLocked(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return repo, nil
+}
+
+func (repo *FileChallengeRepository) loadLocked() error {
+	if err := lockFile(repo.lockFile); err != nil {
+		return err
+	}
+	defer unlockFile(repo.lockFile)
+
+	stat, err := os.Stat(repo.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := repo.load(); err != nil {
+			return err
+		}
+		repo.remember(stat)
+	}
+
+	repo.unsavedLock.Lock()
+	defer repo.unsavedLock.Unlock()
+	repo.replayLog()
+	return nil
+}
@@ -0,0 +1,190 @@
+package stuff
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileChallengeRepositoryPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "challenges.json")
+
+	repo, err := NewFileChallengeRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := &Challenge{
+		ID:         "foo",
+		SharedPath: "/bar",
+	}
+	challenge.SetPassword("baz")
+	challenge.SetExpirationDate(time.Now().Add(time.Hour))
+	challenge.SetMaxViewCount(3)
+	repo.Set(challenge)
+	repo.ReportChallengeView(challenge, "/bar/qux", httptest.NewRequest("GET", "/view/foo/qux", nil))
+
+	reloaded, err := NewFileChallengeRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := reloaded.Get("foo")
+	if actual == nil {
+		t.Fatal("expected challenge foo to be reloaded")
+	}
+	if actual.SharedPath != "/bar" || !actual.Expires || actual.MaxViewCount != 3 {
+		t.Errorf("unexpected reloaded challenge %+v", actual)
+	}
+	if actual.CheckPassword("baz") != nil {
+		t.Error("expected reloaded password hash to match")
+	}
+	if actual.ViewCount != 1 || len(actual.Views()) != 1 {
+		t.Errorf("expected 1 view but got %d (%d logged)", actual.ViewCount, len(actual.Views()))
+	}
+}
+
+func TestFileChallengeRepositorySeesOtherProcessChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "challenges.json")
+
+	server, err := NewFileChallengeRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Set(&Challenge{ID: "foo"})
+
+	cli, err := NewFileChallengeRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Set(&Challenge{ID: "bar"})
+	cli.Remove(&Challenge{ID: "foo"})
+
+	if server.Get("bar") == nil {
+		t.Error("expected server to see challenge bar added by another repository")
+	}
+	if server.Get("foo") != nil {
+		t.Error("expected server to see challenge foo removed by another repository")
+	}
+}
+
+func TestFileChallengeRepositoryKeepsServedBytesAcrossReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "challenges.json")
+
+	server, err := NewFileChallengeRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Set(&Challenge{ID: "foo"})
+	server.ReserveChallengeBytes(&Challenge{ID: "foo"}, 100)
+
+	cli, err := NewFileChallengeRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Set(&Challenge{ID: "bar"})
+
+	if served := server.Get("foo").ServedBytes; served != 100 {
+		t.Errorf("expected 100 served bytes to survive another process's save but got %d", served)
+	}
+	server.Set(server.Get("bar"))
+
+	reloaded, err := NewFileChallengeRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served := reloaded.Get("foo").ServedBytes; served != 100 {
+		t.Errorf("expected 100 served bytes to be saved but got %d", served)
+	}
+}
+
+func TestFileChallengeRepositoryDoesNotLoseConcurrentChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "challenges.json")
+
+	repos := make([]ChallengeRepository, 4)
+	for i := range repos {
+		repo, err := NewFileChallengeRepository(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repos[i] = repo
+	}
+	repos[0].Set(&Challenge{ID: "foo", Public: true})
+
+	var wg sync.WaitGroup
+	for _, repo := range repos {
+		wg.Add(1)
+		go func(repo ChallengeRepository) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				repo.ReportChallengeView(&Challenge{ID: "foo"}, "/", httptest.NewRequest("GET", "/", nil))
+			}
+		}(repo)
+	}
+	wg.Wait()
+
+	if actual := repos[0].Get("foo").ViewCount; actual != 40 {
+		t.Errorf("expected 40 views but got %d", actual)
+	}
+}
+
+func TestFileChallengeRepositoryLogsViewsUntilCompacting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "challenges.json")
+
+	repo, err := NewFileChallengeRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.Set(&Challenge{ID: "foo", Public: true})
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	view, err := repo.ReserveChallengeView(&Challenge{ID: "foo"}, "/bar", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	view.Bytes = 42
+	repo.CompleteChallengeView(&Challenge{ID: "foo"}, view)
+
+	if after, err := os.Stat(path); err != nil || !os.SameFile(before, after) {
+		t.Error("expected views to be logged rather than rewriting the challenges file")
+	}
+
+	// a crash halfway through writing an entry
+	logFile, err := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFile.WriteString(`{"ID":"foo","Ind`)
+	logFile.Close()
+
+	reloaded, err := NewFileChallengeRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := reloaded.Get("foo")
+	if actual.ViewCount != 1 || actual.FileViewCounts["/bar"] != 1 || len(actual.Views()) != 1 || actual.Views()[0].Bytes != 42 {
+		t.Errorf("unexpected reloaded challenge %+v with views %+v", actual, actual.Views())
+	}
+
+	reloaded.ReportChallengeView(&Challenge{ID: "foo"}, "/bar", httptest.NewRequest("GET", "/", nil))
+	for i := 0; i < challengeLogCompactAfter; i++ {
+		reloaded.ReportFailedUnlock(&Challenge{ID: "foo"}, "/", httptest.NewRequest("GET", "/", nil))
+	}
+	if stat, err := os.Stat(path + ".log"); err != nil || stat.Size() > 1000 {
+		t.Errorf("expected the log to be folded into the challenges file, %v", err)
+	}
+
+	compacted, err := NewFileChallengeRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := compacted.Get("foo"); actual.ViewCount != 2 || len(actual.Views()) != challengeLogCompactAfter+2 {
+		t.Errorf("expected 2 counted of %d views but got %d of %d", challengeLogCompactAfter+2, actual.ViewCount, len(actual.Views()))
+	}
+}
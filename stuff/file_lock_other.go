@@ -0,0 +1,15 @@
+//go:build !unix
+
+package stuff
+
+import "os"
+
+// lockFile does nothing where flock isn't available, so processes sharing
+// a state directory can overwrite each other's changes there.
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package stuff
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile blocks until this process holds an exclusive lock on file.
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,96 @@
+package stuff
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseNetwork normalizes a CIDR like "10.0.0.0/8", or a single address,
+// which becomes a /32 or /128.
+func ParseNetwork(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", value)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an IP address or CIDR", value)
+	}
+	return network, nil
+}
+
+// ParseNetworks splits a list of networks separated by commas, spaces or newlines,
+// normalizing each with ParseNetwork.
+func ParseNetworks(value string) ([]string, error) {
+	networks := []string{}
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	})
+	for _, field := range fields {
+		network, err := ParseNetwork(field)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network.String())
+	}
+	return networks, nil
+}
+
+func matchNetwork(networks []string, ip net.IP) string {
+	for _, value := range networks {
+		if network, err := ParseNetwork(value); err == nil && network.Contains(ip) {
+			return network.String()
+		}
+	}
+	return ""
+}
+
+// HasNetworkRules checks if the challenge restricts where it can be opened from.
+func (challenge *Challenge) HasNetworkRules() bool {
+	return len(challenge.AllowedNetworks) > 0 || len(challenge.DeniedNetworks) > 0
+}
+
+// NetworkRule decides whether ip may open the challenge, and describes the rule
+// that decided it, like "deny 10.0.0.0/8". Denials win over allows, and with an
+// allowlist, addresses not on it are refused. Without rules, anyone is allowed.
+func (challenge *Challenge) NetworkRule(ip string) (rule string, allowed bool) {
+	if !challenge.HasNetworkRules() {
+		return "", true
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "unknown address", false
+	}
+	if network := matchNetwork(challenge.DeniedNetworks, parsed); network != "" {
+		return "deny " + network, false
+	}
+	if len(challenge.AllowedNetworks) == 0 {
+		return "", true
+	}
+	if network := matchNetwork(challenge.AllowedNetworks, parsed); network != "" {
+		return "allow " + network, true
+	}
+	return "not in allowlist", false
+}
+
+// requestIP is the address r came from, without the port. The server replaces
+// RemoteAddr with the real client address when behind a trusted proxy.
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,68 @@
+package stuff
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseNetworksNormalizes(t *testing.T) {
+	networks, err := ParseNetworks("10.1.2.3/8, 192.0.2.7\n2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.0/8", "192.0.2.7/32", "2001:db8::1/128"}
+	if len(networks) != len(expected) {
+		t.Fatalf("expected %v but got %v", expected, networks)
+	}
+	for i := range expected {
+		if networks[i] != expected[i] {
+			t.Errorf("expected %v but got %v", expected[i], networks[i])
+		}
+	}
+
+	if _, err := ParseNetworks("10.0.0.0/33"); err == nil {
+		t.Error("expected an invalid CIDR to be rejected")
+	}
+	if _, err := ParseNetworks("example.com"); err == nil {
+		t.Error("expected a hostname to be rejected")
+	}
+}
+
+func TestNetworkRuleDenyWinsOverAllow(t *testing.T) {
+	challenge := &Challenge{
+		Public:          true,
+		AllowedNetworks: []string{"10.0.0.0/8"},
+		DeniedNetworks:  []string{"10.6.0.0/16"},
+	}
+
+	cases := []struct {
+		ip      string
+		rule    string
+		allowed bool
+	}{
+		{"10.1.2.3", "allow 10.0.0.0/8", true},
+		{"10.6.2.3", "deny 10.6.0.0/16", false},
+		{"192.0.2.1", "not in allowlist", false},
+		{"nonsense", "unknown address", false},
+	}
+	for _, c := range cases {
+		rule, allowed := challenge.NetworkRule(c.ip)
+		if rule != c.rule || allowed != c.allowed {
+			t.Errorf("%v: expected %q %v but got %q %v", c.ip, c.rule, c.allowed, rule, allowed)
+		}
+	}
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.RemoteAddr = "192.0.2.1:1234"
+	if challenge.Accessible(request, nil) {
+		t.Error("expected a public challenge to still refuse addresses outside its allowlist")
+	}
+	request.RemoteAddr = "10.1.2.3:1234"
+	if !challenge.Accessible(request, nil) {
+		t.Error("expected an allowed address to open the challenge")
+	}
+
+	if rule, allowed := (&Challenge{}).NetworkRule("nonsense"); rule != "" || !allowed {
+		t.Errorf("expected challenges without rules to allow anyone but got %q %v", rule, allowed)
+	}
+}
@@ -0,0 +1,92 @@
+package stuff
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenSigner issues and checks expiring HMAC-SHA256 tokens.
+// A token is only valid for the purpose and subject it was signed for.
+type TokenSigner struct {
+	Key []byte
+}
+
+func (signer *TokenSigner) mac(purpose string, subject string, expires string) []byte {
+	mac := hmac.New(sha256.New, signer.Key)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write([]byte(subject))
+	mac.Write([]byte{0})
+	mac.Write([]byte(expires))
+	return mac.Sum(nil)
+}
+
+func (signer *TokenSigner) Sign(purpose string, subject string, expires time.Time) string {
+	expiresString := strconv.FormatInt(expires.Unix(), 10)
+	return expiresString + "." + base64.RawURLEncoding.EncodeToString(signer.mac(purpose, subject, expiresString))
+}
+
+func (signer *TokenSigner) Verify(token string, purpose string, subject string) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().After(time.Unix(expires, 0)) {
+		return false
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(signature, signer.mac(purpose, subject, parts[0]))
+}
+
+// SessionStore remembers which password-protected challenges a visitor has unlocked.
+type SessionStore interface {
+	Unlock(challenge *Challenge, w http.ResponseWriter)
+	Unlocked(challenge *Challenge, r *http.Request) bool
+}
+
+const challengeUnlockPurpose = "challenge-unlock"
+
+// HMACSessionStore keeps unlocks in signed cookies instead of server-side state.
+// Tokens are bound to the challenge's password hash and session version, so
+// setting a new password or bumping the version revokes every existing session.
+type HMACSessionStore struct {
+	Signer   *TokenSigner
+	Lifetime time.Duration
+}
+
+func (store *HMACSessionStore) subject(challenge *Challenge) string {
+	return challenge.ID + "\x00" + challenge.PasswordHash + "\x00" + strconv.Itoa(challenge.SessionVersion)
+}
+
+func (store *HMACSessionStore) Unlock(challenge *Challenge, w http.ResponseWriter) {
+	expires := time.Now().Add(store.Lifetime)
+	http.SetCookie(w, &http.Cookie{
+		Name:     challenge.CookieName(),
+		Path:     "/",
+		Value:    store.Signer.Sign(challengeUnlockPurpose, store.subject(challenge), expires),
+		MaxAge:   int(store.Lifetime.Seconds()),
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (store *HMACSessionStore) Unlocked(challenge *Challenge, r *http.Request) bool {
+	cookie, _ := r.Cookie(challenge.CookieName())
+	if cookie == nil {
+		return false
+	}
+	return store.Signer.Verify(cookie.Value, challengeUnlockPurpose, store.subject(challenge))
+}
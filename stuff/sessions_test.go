@@ -0,0 +1,62 @@
+package stuff
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHMACSessionStoreRevokedByPasswordChange(t *testing.T) {
+	store := &HMACSessionStore{
+		Signer:   &TokenSigner{Key: []byte("secret")},
+		Lifetime: time.Hour,
+	}
+
+	challenge := &Challenge{ID: "foo"}
+	challenge.SetPassword("bar")
+
+	recorder := httptest.NewRecorder()
+	store.Unlock(challenge, recorder)
+
+	request := httptest.NewRequest("GET", "/view/foo", nil)
+	for _, cookie := range recorder.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+
+	if !store.Unlocked(challenge, request) {
+		t.Fatal("expected challenge to be unlocked")
+	}
+
+	other := &Challenge{ID: "baz", PasswordHash: challenge.PasswordHash}
+	if store.Unlocked(other, request) {
+		t.Error("expected session to be bound to the challenge ID")
+	}
+
+	signedOut := *challenge
+	signedOut.SessionVersion++
+	if store.Unlocked(&signedOut, request) {
+		t.Error("expected bumping the session version to revoke the session")
+	}
+
+	challenge.SetPassword("bar")
+	if store.Unlocked(challenge, request) {
+		t.Error("expected setting a new password to revoke the session")
+	}
+}
+
+func TestTokenSignerExpiry(t *testing.T) {
+	signer := &TokenSigner{Key: []byte("secret")}
+
+	token := signer.Sign("purpose", "subject", time.Now().Add(-time.Second))
+	if signer.Verify(token, "purpose", "subject") {
+		t.Error("expected expired token to be rejected")
+	}
+
+	token = signer.Sign("purpose", "subject", time.Now().Add(time.Minute))
+	if !signer.Verify(token, "purpose", "subject") {
+		t.Error("expected token to verify")
+	}
+	if signer.Verify(token, "other-purpose", "subject") {
+		t.Error("expected token to be bound to its purpose")
+	}
+}
@@ -0,0 +1,170 @@
+package stuff
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// UnlockLimiter slows down password guessing on challenges. Failures are counted
+// per challenge and client IP, with IPv6 addresses grouped by /64, and per challenge
+// across all IPs. Once a threshold is reached each further failure locks the pair,
+// or the whole challenge, out for Lockout, doubling every time up to MaxLockout.
+// Failures are forgotten MaxLockout after the last one.
+type UnlockLimiter struct {
+	// Threshold is how many wrong passwords one IP may send before locking, 0 to never lock.
+	Threshold int
+	// ChallengeThreshold is how many wrong passwords all IPs together may send before
+	// locking everyone out of the challenge, 0 to never lock.
+	ChallengeThreshold int
+	Lockout            time.Duration
+	MaxLockout         time.Duration
+
+	lock      sync.Mutex
+	attempts  map[unlockKey]*unlockAttempts
+	lastPrune time.Time
+}
+
+// unlockKey is a challenge and IP group, or a challenge on its own when ip is empty.
+type unlockKey struct {
+	challengeID string
+	ip          string
+}
+
+type unlockAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// unlockGroup is who ip is limited together with. A single IPv6 client
+// usually has a whole /64 to pick addresses from.
+func unlockGroup(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return ip
+	}
+	return parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+func (limiter *UnlockLimiter) keys(challengeID string, ip string) []unlockKey {
+	return []unlockKey{{challengeID, unlockGroup(ip)}, {challengeID, ""}}
+}
+
+// threshold is the number of failures key may have before it is locked.
+func (limiter *UnlockLimiter) threshold(key unlockKey) int {
+	if key.ip == "" {
+		return limiter.ChallengeThreshold
+	}
+	return limiter.Threshold
+}
+
+// Locked returns how long the IP must wait before guessing again, or 0 if it may guess now.
+func (limiter *UnlockLimiter) Locked(challengeID string, ip string) time.Duration {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	return limiter.locked(challengeID, ip, time.Now())
+}
+
+func (limiter *UnlockLimiter) locked(challengeID string, ip string, now time.Time) time.Duration {
+	var wait time.Duration
+	for _, key := range limiter.keys(challengeID, ip) {
+		if attempts, exists := limiter.attempts[key]; exists && attempts.lockedUntil.Sub(now) > wait {
+			wait = attempts.lockedUntil.Sub(now)
+		}
+	}
+	return wait
+}
+
+// lockoutAfter is how long the failure'th failure locks for, given the threshold.
+func (limiter *UnlockLimiter) lockoutAfter(threshold int, failures int) time.Duration {
+	if threshold <= 0 || failures < threshold {
+		return 0
+	}
+
+	lockout := limiter.Lockout
+	for i := threshold; i < failures && lockout < limiter.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > limiter.MaxLockout {
+		lockout = limiter.MaxLockout
+	}
+	return lockout
+}
+
+// Attempt reserves a guess at the password of a challenge before it is checked,
+// counting it as wrong until Succeed says otherwise, so parallel guesses can't all
+// slip in under the threshold. If the IP is locked out it returns how long to wait
+// and false. Otherwise it returns how long a wrong guess locks the IP out for, or 0.
+func (limiter *UnlockLimiter) Attempt(challengeID string, ip string) (time.Duration, bool) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	if wait := limiter.locked(challengeID, ip, time.Now()); wait > 0 {
+		return wait, false
+	}
+	return limiter.fail(challengeID, ip), true
+}
+
+// fail counts a wrong password and returns how long the IP is now locked out for, or 0.
+func (limiter *UnlockLimiter) fail(challengeID string, ip string) time.Duration {
+	now := time.Now()
+	limiter.prune(now)
+
+	if limiter.attempts == nil {
+		limiter.attempts = make(map[unlockKey]*unlockAttempts)
+	}
+
+	var longest time.Duration
+	for _, key := range limiter.keys(challengeID, ip) {
+		attempts, exists := limiter.attempts[key]
+		if !exists || limiter.forgotten(attempts, now) {
+			attempts = &unlockAttempts{}
+			limiter.attempts[key] = attempts
+		}
+
+		attempts.failures++
+		attempts.lastFailure = now
+
+		lockout := limiter.lockoutAfter(limiter.threshold(key), attempts.failures)
+		attempts.lockedUntil = now.Add(lockout)
+		if lockout > longest {
+			longest = lockout
+		}
+	}
+	return longest
+}
+
+// Succeed forgets the failures of an IP that got the password right, and takes
+// back the guess Attempt counted against the challenge.
+func (limiter *UnlockLimiter) Succeed(challengeID string, ip string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	keys := limiter.keys(challengeID, ip)
+	delete(limiter.attempts, keys[0])
+
+	if attempts, exists := limiter.attempts[keys[1]]; exists && attempts.failures > 0 {
+		attempts.failures--
+		attempts.lockedUntil = attempts.lastFailure.Add(limiter.lockoutAfter(limiter.ChallengeThreshold, attempts.failures))
+	}
+}
+
+func (limiter *UnlockLimiter) forgotten(attempts *unlockAttempts, now time.Time) bool {
+	return now.After(attempts.lockedUntil) && now.Sub(attempts.lastFailure) > limiter.MaxLockout
+}
+
+// prune drops failures old enough to be forgotten, at most once a minute.
+func (limiter *UnlockLimiter) prune(now time.Time) {
+	if now.Sub(limiter.lastPrune) < time.Minute {
+		return
+	}
+	limiter.lastPrune = now
+
+	for key, attempts := range limiter.attempts {
+		if limiter.forgotten(attempts, now) {
+			delete(limiter.attempts, key)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package stuff
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUnlockLimiterBacksOffExponentially(t *testing.T) {
+	limiter := &UnlockLimiter{
+		Threshold:  3,
+		Lockout:    time.Minute,
+		MaxLockout: 5 * time.Minute,
+	}
+
+	want := []time.Duration{0, 0, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, expected := range want {
+		if lockout := limiter.fail("foo", "10.0.0.1"); lockout != expected {
+			t.Errorf("failure %d: got lockout %v, want %v", i+1, lockout, expected)
+		}
+	}
+
+	if limiter.Locked("foo", "10.0.0.1") <= 0 {
+		t.Error("expected the IP to be locked out")
+	}
+	if limiter.Locked("foo", "10.0.0.2") != 0 {
+		t.Error("expected other IPs not to be locked out")
+	}
+	if limiter.Locked("bar", "10.0.0.1") != 0 {
+		t.Error("expected other challenges not to be locked out")
+	}
+
+	limiter.Succeed("foo", "10.0.0.1")
+	if limiter.Locked("foo", "10.0.0.1") != 0 {
+		t.Error("expected success to clear the lockout")
+	}
+}
+
+func TestUnlockLimiterForgetsOldFailures(t *testing.T) {
+	limiter := &UnlockLimiter{
+		Threshold:  2,
+		Lockout:    time.Millisecond,
+		MaxLockout: 10 * time.Millisecond,
+	}
+
+	limiter.fail("foo", "10.0.0.1")
+	time.Sleep(20 * time.Millisecond)
+
+	if lockout := limiter.fail("foo", "10.0.0.1"); lockout != 0 {
+		t.Errorf("expected the old failure to be forgotten, got lockout %v", lockout)
+	}
+}
+
+func TestUnlockLimiterDisabled(t *testing.T) {
+	limiter := &UnlockLimiter{Lockout: time.Minute, MaxLockout: time.Hour}
+
+	for i := 0; i < 100; i++ {
+		if lockout := limiter.fail("foo", "10.0.0.1"); lockout != 0 {
+			t.Fatalf("expected a threshold of 0 to never lock, got %v", lockout)
+		}
+	}
+}
+
+func TestUnlockLimiterReservesAttemptsConcurrently(t *testing.T) {
+	limiter := &UnlockLimiter{
+		Threshold:  3,
+		Lockout:    time.Minute,
+		MaxLockout: time.Hour,
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := limiter.Attempt("foo", "10.0.0.1"); ok {
+				lock.Lock()
+				allowed++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 3 {
+		t.Errorf("expected 3 guesses to be let through but got %d", allowed)
+	}
+}
+
+func TestUnlockLimiterSucceedReleasesAttempt(t *testing.T) {
+	limiter := &UnlockLimiter{
+		Threshold:          2,
+		ChallengeThreshold: 2,
+		Lockout:            time.Minute,
+		MaxLockout:         time.Hour,
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, ok := limiter.Attempt("foo", "10.0.0.1"); !ok {
+			t.Fatalf("attempt %d: expected right passwords never to lock out", i+1)
+		}
+		limiter.Succeed("foo", "10.0.0.1")
+	}
+}
+
+func TestUnlockLimiterLocksChallengeAcrossIPs(t *testing.T) {
+	limiter := &UnlockLimiter{
+		Threshold:          3,
+		ChallengeThreshold: 5,
+		Lockout:            time.Minute,
+		MaxLockout:         time.Hour,
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, ok := limiter.Attempt("foo", fmt.Sprintf("10.0.0.%d", i+1)); !ok {
+			t.Fatalf("attempt %d: expected to be let through", i+1)
+		}
+	}
+	if _, ok := limiter.Attempt("foo", "10.0.1.1"); ok {
+		t.Error("expected a fresh IP to be locked out of a challenge guessed at too often")
+	}
+	if _, ok := limiter.Attempt("bar", "10.0.1.1"); !ok {
+		t.Error("expected other challenges not to be locked out")
+	}
+}
+
+func TestUnlockLimiterGroupsIPv6Networks(t *testing.T) {
+	limiter := &UnlockLimiter{
+		Threshold:  2,
+		Lockout:    time.Minute,
+		MaxLockout: time.Hour,
+	}
+
+	limiter.Attempt("foo", "2001:db8::1")
+	limiter.Attempt("foo", "2001:db8::2")
+	if _, ok := limiter.Attempt("foo", "2001:db8::ffff:3"); ok {
+		t.Error("expected addresses in the same /64 to share a lockout")
+	}
+	if _, ok := limiter.Attempt("foo", "2001:db8:0:1::1"); !ok {
+		t.Error("expected other /64s not to be locked out")
+	}
+}
+
+func TestReportFailedUnlockIsNotAView(t *testing.T) {
+	repo := NewArrayChallengeRepository()
+	challenge := &Challenge{ID: "foo"}
+	challenge.SetMaxViewCount(1)
+	repo.Set(challenge)
+
+	repo.ReportFailedUnlock(challenge, "/", httptest.NewRequest("POST", "/view/foo", nil))
+
+	stored := repo.Get("foo")
+	if stored.ViewCount != 0 || stored.HitMaxViewCount() {
+		t.Error("expected a wrong password not to use up a view")
+	}
+	views := stored.Views()
+	if len(views) != 1 || !views[0].FailedUnlock {
+		t.Fatalf("expected the wrong password in the activity log, got %+v", views)
+	}
+}
@@ -0,0 +1,173 @@
+package stuff
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// View counting policies decide which requests use up a challenge's views.
+// Under all of them, range requests that carry on with a file the visitor already
+// used a view on are free, as long as they don't ask for bytes sent to them before.
+const (
+	// ViewCountingRequest counts every request, the default.
+	ViewCountingRequest = "request"
+	// ViewCountingFile counts each file once per visitor.
+	ViewCountingFile = "file"
+	// ViewCountingDownload counts each file once per visitor, and only once
+	// it has been sent to the end.
+	ViewCountingDownload = "download"
+)
+
+// ViewCountings lists the view counting policies.
+var ViewCountings = []string{
+	ViewCountingRequest,
+	ViewCountingFile,
+	ViewCountingDownload,
+}
+
+// IsViewCounting checks if policy is one of ViewCountings.
+func IsViewCounting(policy string) bool {
+	for _, known := range ViewCountings {
+		if policy == known {
+			return true
+		}
+	}
+	return false
+}
+
+// VisitorCookieName holds a random ID that tells visitors apart for view counting.
+const VisitorCookieName = "creamy-visitor"
+
+// ViewCountingPolicy is ViewCounting, with the default filled in.
+func (challenge *Challenge) ViewCountingPolicy() string {
+	if challenge.ViewCounting == "" {
+		return ViewCountingRequest
+	}
+	return challenge.ViewCounting
+}
+
+// CountsRepeats checks if fetching the same file again uses up another view,
+// which makes streaming media inline too costly under a view limit.
+func (challenge *Challenge) CountsRepeats() bool {
+	return challenge.ViewCountingPolicy() == ViewCountingRequest
+}
+
+// visitor tells apart who made request, by their visitor cookie or else their address.
+func visitor(request *http.Request) string {
+	if cookie, err := request.Cookie(VisitorCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	return requestIP(request)
+}
+
+// requestedRange returns the single range request asks for, from start up to but
+// not including end, which is math.MaxInt64 for the rest of the file.
+// Several ranges at once, or a range from the end, aren't understood.
+func requestedRange(request *http.Request) (int64, int64, bool) {
+	ranges := strings.TrimSpace(request.Header.Get("Range"))
+	if !strings.HasPrefix(ranges, "bytes=") || strings.Contains(ranges, ",") {
+		return 0, 0, false
+	}
+
+	start, end, found := strings.Cut(strings.TrimPrefix(ranges, "bytes="), "-")
+	if !found {
+		return 0, 0, false
+	}
+	startOffset, err := strconv.ParseInt(strings.TrimSpace(start), 10, 64)
+	if err != nil || startOffset < 0 {
+		return 0, 0, false
+	}
+	if strings.TrimSpace(end) == "" {
+		return startOffset, math.MaxInt64, true
+	}
+	endOffset, err := strconv.ParseInt(strings.TrimSpace(end), 10, 64)
+	if err != nil || endOffset < startOffset || endOffset == math.MaxInt64 {
+		return 0, 0, false
+	}
+	return startOffset, endOffset + 1, true
+}
+
+// isRangeContinuation checks for requests of a single range that doesn't start at the
+// beginning of the file, like a video player seeking or a download resuming.
+// Several ranges at once, or a range from the end, could add up to the whole file.
+func isRangeContinuation(request *http.Request) bool {
+	start, _, ok := requestedRange(request)
+	return ok && start > 0
+}
+
+// HasSeveralRanges checks if request asks for more than one range of a file.
+func HasSeveralRanges(request *http.Request) bool {
+	return strings.Contains(request.Header.Get("Range"), ",")
+}
+
+// countedFor checks if visitor already used up a view on filePath, or on any file if it is empty.
+func (challenge *Challenge) countedFor(visitor string, filePath string) bool {
+	for _, view := range challenge.views {
+		if !view.Upload && !view.FailedUnlock && !view.Uncounted && view.Visitor == visitor && (filePath == "" || view.FilePath == filePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// countsRequest decides if a request for filePath uses up a view when it is made.
+// Under ViewCountingDownload, views are counted once complete instead.
+func (challenge *Challenge) countsRequest(filePath string, request *http.Request) bool {
+	switch challenge.ViewCountingPolicy() {
+	case ViewCountingFile:
+		return !challenge.countedFor(visitor(request), filePath)
+	case ViewCountingDownload:
+		return false
+	}
+	return !challenge.continuesView(filePath, request)
+}
+
+// ContinuesView checks if request may carry on with a view its visitor already used up,
+// even though the challenge hit its view limit. Other limits still apply.
+func (challenge *Challenge) ContinuesView(request *http.Request) bool {
+	return !challenge.Expired() && !challenge.HitByteQuota() && challenge.continuesView("", request)
+}
+
+// continuesView checks if request only carries on with a view of filePath that
+// was already counted, like a player seeking in a video. These stay allowed once
+// the view limit is hit, so the last view can still be watched to the end.
+func (challenge *Challenge) continuesView(filePath string, request *http.Request) bool {
+	if !challenge.CountsRepeats() {
+		return challenge.countedFor(visitor(request), filePath)
+	}
+
+	if !isRangeContinuation(request) {
+		return false
+	}
+	if filePath == "" {
+		return challenge.countedFor(visitor(request), "")
+	}
+	start, end, _ := requestedRange(request)
+	return challenge.continuesRange(visitor(request), filePath, start, end)
+}
+
+// continuesRange checks if visitor's last counted view of filePath, and the free
+// continuations since, haven't sent any of the bytes from start to end yet.
+// Views still being sent are assumed to send everything they asked for.
+func (challenge *Challenge) continuesRange(visitor string, filePath string, start int64, end int64) bool {
+	for i := len(challenge.views) - 1; i >= 0; i-- {
+		view := challenge.views[i]
+		if view.Upload || view.FailedUnlock || view.Visitor != visitor || view.FilePath != filePath {
+			continue
+		}
+
+		sentEnd := int64(math.MaxInt64)
+		if view.Status != 0 {
+			sentEnd = view.Offset + view.Bytes
+		}
+		if start < sentEnd && view.Offset < end {
+			return false
+		}
+		if !view.Uncounted {
+			return true
+		}
+	}
+	return false
+}
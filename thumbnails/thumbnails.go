@@ -0,0 +1,259 @@
+// Package thumbnails generates and caches small JPEG previews of images and videos.
+package thumbnails
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	// decoders registered with image.Decode
+	_ "image/gif"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/image/draw"
+)
+
+// ErrUnsupported is returned for files we can't make a thumbnail of.
+var ErrUnsupported = errors.New("no thumbnail available for this file")
+
+// maxPixels stops us from decoding images so large they'd exhaust memory.
+const maxPixels = 64 * 1024 * 1024
+
+const ffmpegTimeout = 30 * time.Second
+
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+	".bmp":  true,
+}
+
+var videoExtensions = map[string]bool{
+	".mp4":  true,
+	".m4v":  true,
+	".mov":  true,
+	".webm": true,
+	".mkv":  true,
+	".avi":  true,
+}
+
+type Generator struct {
+	// CacheDirectory holds generated thumbnails, named after a hash of the
+	// source path, size and modification time so stale ones are never served.
+	CacheDirectory string
+	// Size is the maximum width and height of a thumbnail.
+	Size int
+	// FFmpegPath makes poster frames for videos. Empty disables video thumbnails.
+	FFmpegPath string
+
+	// slots limits how many thumbnails are generated at once
+	slots chan struct{}
+}
+
+// New makes a Generator. ffmpeg is looked up in $PATH, or used as a path
+// if it contains a slash; video thumbnails are disabled if it can't be found.
+func New(cacheDirectory string, size int, ffmpeg string, concurrency int) *Generator {
+	ffmpegPath := ""
+	if ffmpeg != "" {
+		ffmpegPath, _ = exec.LookPath(ffmpeg)
+	}
+
+	return &Generator{
+		CacheDirectory: cacheDirectory,
+		Size:           size,
+		FFmpegPath:     ffmpegPath,
+
+		slots: make(chan struct{}, concurrency),
+	}
+}
+
+func extension(name string) string {
+	return strings.ToLower(filepath.Ext(name))
+}
+
+// Supported reports whether a thumbnail can probably be made for a file with this name.
+func (generator *Generator) Supported(name string) bool {
+	ext := extension(name)
+	return imageExtensions[ext] || (generator.FFmpegPath != "" && videoExtensions[ext])
+}
+
+func (generator *Generator) cachePath(filePath string, stat os.FileInfo) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%d\x00%d\x00%d", filePath, generator.Size, stat.Size(), stat.ModTime().UnixNano())
+	return filepath.Join(generator.CacheDirectory, hex.EncodeToString(hash.Sum(nil))+".jpg")
+}
+
+// Thumbnail returns the path of a cached JPEG thumbnail of the file at filePath,
+// generating it first if needed.
+func (generator *Generator) Thumbnail(filePath string) (string, error) {
+	if !generator.Supported(filePath) {
+		return "", ErrUnsupported
+	}
+
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	if !stat.Mode().IsRegular() {
+		return "", ErrUnsupported
+	}
+
+	cachePath := generator.cachePath(filePath, stat)
+	if _, err := os.Stat(cachePath); err == nil {
+		return cachePath, nil
+	}
+
+	generator.slots <- struct{}{}
+	defer func() { <-generator.slots }()
+
+	// someone else may have generated it while we waited
+	if _, err := os.Stat(cachePath); err == nil {
+		return cachePath, nil
+	}
+
+	var source image.Image
+	if imageExtensions[extension(filePath)] {
+		source, err = decodeImage(filePath)
+	} else {
+		source, err = generator.posterFrame(filePath)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := generator.write(cachePath, scale(source, generator.Size)); err != nil {
+		return "", err
+	}
+	return cachePath, nil
+}
+
+func decodeImage(filePath string) (image.Image, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	imageConfig, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if imageConfig.Width*imageConfig.Height > maxPixels {
+		return nil, ErrUnsupported
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	source, _, err := image.Decode(file)
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	return source, nil
+}
+
+// posterFrame grabs a frame from a second into the video, or the first frame of very short ones.
+func (generator *Generator) posterFrame(filePath string) (image.Image, error) {
+	for _, offset := range []string{"1", "0"} {
+		ctx, cancel := context.WithTimeout(context.Background(), ffmpegTimeout)
+		output, err := exec.CommandContext(
+			ctx,
+			generator.FFmpegPath,
+			"-v", "error",
+			"-ss", offset,
+			"-i", filePath,
+			"-frames:v", "1",
+			"-vf", "scale='min("+strconv.Itoa(generator.Size*2)+",iw)':-2",
+			"-f", "image2pipe",
+			"-c:v", "png",
+			"-",
+		).Output()
+		cancel()
+
+		if err != nil {
+			return nil, fmt.Errorf("ffmpeg: %w", err)
+		}
+		if len(output) == 0 {
+			continue
+		}
+
+		frame, _, err := image.Decode(bytes.NewReader(output))
+		if err != nil {
+			return nil, fmt.Errorf("decoding ffmpeg output: %w", err)
+		}
+		return frame, nil
+	}
+
+	return nil, ErrUnsupported
+}
+
+// background shows through transparent images, since JPEGs have no alpha channel.
+// It matches the page background.
+var background = image.NewUniform(color.RGBA{27, 27, 27, 255})
+
+// scale shrinks source to fit within size by size, keeping its aspect ratio.
+// Images that already fit are not enlarged.
+func scale(source image.Image, size int) image.Image {
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width > size || height > size {
+		if width > height {
+			height = height * size / width
+			width = size
+		} else {
+			width = width * size / height
+			height = size
+		}
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(scaled, scaled.Bounds(), background, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), source, bounds, draw.Over, nil)
+	return scaled
+}
+
+func (generator *Generator) write(cachePath string, thumbnail image.Image) error {
+	if err := os.MkdirAll(generator.CacheDirectory, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(generator.CacheDirectory, "thumbnail.*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := jpeg.Encode(tmp, thumbnail, &jpeg.Options{Quality: 80}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), cachePath)
+}
@@ -0,0 +1,71 @@
+package thumbnails
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestThumbnailScalesAndCaches(t *testing.T) {
+	dir := t.TempDir()
+	sourcePath := filepath.Join(dir, "wide.png")
+
+	source := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	for x := 0; x < 400; x++ {
+		for y := 0; y < 100; y++ {
+			source.Set(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+	file, err := os.Create(sourcePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(file, source); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	generator := New(filepath.Join(dir, "cache"), 64, "", 1)
+
+	thumbnailPath, err := generator.Thumbnail(sourcePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thumbnailFile, err := os.Open(thumbnailPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer thumbnailFile.Close()
+
+	thumbnail, err := jpeg.Decode(thumbnailFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounds := thumbnail.Bounds(); bounds.Dx() != 64 || bounds.Dy() != 16 {
+		t.Errorf("expected 64x16 thumbnail but got %dx%d", bounds.Dx(), bounds.Dy())
+	}
+
+	cachedPath, err := generator.Thumbnail(sourcePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cachedPath != thumbnailPath {
+		t.Errorf("expected cached thumbnail %s but got %s", thumbnailPath, cachedPath)
+	}
+}
+
+func TestThumbnailUnsupported(t *testing.T) {
+	generator := New(t.TempDir(), 64, "", 1)
+
+	if _, err := generator.Thumbnail("notes.txt"); err != ErrUnsupported {
+		t.Errorf("expected ErrUnsupported but got %v", err)
+	}
+	if generator.Supported("movie.mp4") {
+		t.Error("expected videos to be unsupported without ffmpeg")
+	}
+}
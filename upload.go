@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/AlbinoDrought/creamy-stuff/stuff"
+	"github.com/AlbinoDrought/creamy-stuff/templates"
+)
+
+// uploadFormOverhead is allowed on top of a challenge's remaining upload bytes
+// for multipart headers and the CSRF token.
+const uploadFormOverhead = 1024 * 1024
+
+// maxUploadNameAttempts stops us looking for a free file name forever.
+const maxUploadNameAttempts = 1000
+
+var errUploadName = errors.New("invalid file name")
+var errUploadExtension = errors.New("file type not allowed")
+
+// parseExtensions normalizes a list like "pdf, .JPG" to []string{".pdf", ".jpg"}.
+func parseExtensions(values []string) []string {
+	extensions := []string{}
+	for _, value := range values {
+		for _, extension := range strings.Split(value, ",") {
+			extension = strings.ToLower(strings.TrimSpace(extension))
+			if extension == "" || extension == "." {
+				continue
+			}
+			if !strings.HasPrefix(extension, ".") {
+				extension = "." + extension
+			}
+			extensions = append(extensions, extension)
+		}
+	}
+	return extensions
+}
+
+// uploadFileName strips any directories and leading dots from a name sent by the browser.
+func uploadFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	return strings.TrimLeft(strings.TrimSpace(name), ".")
+}
+
+// createUploadFile creates name in directory, adding a number like "name (1).txt"
+// instead of overwriting an existing file.
+func createUploadFile(directory string, name string) (*os.File, string, error) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	for i := 0; i < maxUploadNameAttempts; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+
+		file, err := os.OpenFile(path.Join(directory, candidate), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		return file, candidate, err
+	}
+
+	return nil, "", fmt.Errorf("no free file name for %s", name)
+}
+
+// saveChallengeUpload streams one uploaded file to disk and counts it against the challenge's limits.
+// Files that don't fit are removed again.
+func saveChallengeUpload(r *http.Request, challenge *stuff.Challenge, directory string, part *multipart.Part) (string, error) {
+	name := uploadFileName(part.FileName())
+	if name == "" {
+		return "", errUploadName
+	}
+	if !challenge.AllowsExtension(name) || dataFileSystem.Hidden(name) {
+		return name, errUploadExtension
+	}
+
+	// other uploads may have used up some of the limit since the form was opened
+	current := challengeRepository.Get(challenge.ID)
+	if current == nil {
+		return name, stuff.ErrChallengeNotFound
+	}
+	remaining := current.RemainingUploadBytes()
+
+	file, name, err := createUploadFile(directory, name)
+	if err != nil {
+		return name, err
+	}
+
+	var reader io.Reader = part
+	if remaining >= 0 {
+		reader = io.LimitReader(part, remaining+1)
+	}
+	size, err := io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && remaining >= 0 && size > remaining {
+		err = stuff.ErrChallengeUploadLimitReached
+	}
+	if err == nil {
+		err = challengeRepository.ReserveChallengeUpload(challenge, "/"+name, size, r)
+	}
+	if err != nil {
+		os.Remove(path.Join(directory, name))
+		return name, err
+	}
+
+	return name, nil
+}
+
+func uploadErrorMessage(name string, err error) string {
+	var maxBytesError *http.MaxBytesError
+	switch {
+	case err == errUploadName, err == errUploadExtension:
+	case err == stuff.ErrChallengeUploadLimitReached, errors.As(err, &maxBytesError):
+		err = errors.New("upload limit reached")
+	default:
+		err = errors.New("upload failed")
+	}
+
+	if name == "" {
+		return err.Error()
+	}
+	return name + ": " + err.Error()
+}
+
+func writeUploadPage(w http.ResponseWriter, r *http.Request, challenge *stuff.Challenge, uploaded []string, uploadErrors []string) {
+	csrfToken, err := getOrCreateCSRF(w, r)
+	if err != nil {
+		log.Printf("Error with getOrCreateCSRF: %v", err)
+		renderServerError(w, r, err)
+		return
+	}
+
+	uploadPage := &templates.UploadPage{
+		Name: path.Base(challenge.SharedPath),
+		CSRF: csrfToken,
+
+		AllowedExtensions: challenge.AllowedExtensions,
+		RemainingFiles:    challenge.RemainingUploadFiles(),
+		Full:              challenge.HitUploadLimit(),
+
+		Uploaded: uploaded,
+		Errors:   uploadErrors,
+	}
+	if remaining := challenge.RemainingUploadBytes(); remaining >= 0 {
+		uploadPage.RemainingBytes = templates.FormatBytes(remaining)
+	}
+	templates.WritePageTemplate(w, uploadPage, &templates.EmptyNav{})
+}
+
+// handleChallengeUpload streams files from the upload form straight into the
+// challenge's shared directory, without buffering them in memory.
+func handleChallengeUpload(w http.ResponseWriter, r *http.Request, challenge *stuff.Challenge) {
+	uploadDirectory, err := dataFileSystem.Resolve(challenge.SharedPath)
+	if err != nil {
+		renderOpenError(w, r, challenge.SharedPath, err)
+		return
+	}
+	if stat, err := os.Stat(uploadDirectory); err != nil || !stat.IsDir() {
+		log.Printf("Error opening upload directory %v for challenge %v: %v", uploadDirectory, challenge.ID, err)
+		renderServerError(w, r, err)
+		return
+	}
+
+	if remaining := challenge.RemainingUploadBytes(); remaining >= 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, remaining+uploadFormOverhead)
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		log.Printf("Error reading upload for challenge %v: %v", challenge.ID, err)
+		renderServerError(w, r, err)
+		return
+	}
+
+	// the form puts the CSRF token first, so it is checked before any file is written
+	part, err := reader.NextPart()
+	if err != nil || part.FormName() != "_token" {
+		log.Printf("Error reading CSRF token of upload for challenge %v: %v", challenge.ID, err)
+		renderServerError(w, r, errors.New("missing CSRF token"))
+		return
+	}
+	token, err := io.ReadAll(io.LimitReader(part, 1024))
+	if err != nil {
+		log.Printf("Error reading CSRF token of upload for challenge %v: %v", challenge.ID, err)
+		renderServerError(w, r, err)
+		return
+	}
+	if err := validCSRF(r, string(token)); err != nil {
+		log.Printf("Error validating CSRF token: %v", err)
+		renderServerError(w, r, err)
+		return
+	}
+
+	uploaded := []string{}
+	uploadErrors := []string{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error reading upload for challenge %v: %v", challenge.ID, err)
+			uploadErrors = append(uploadErrors, uploadErrorMessage("", err))
+			break
+		}
+		if part.FormName() != "files" || part.FileName() == "" {
+			continue
+		}
+
+		name, err := saveChallengeUpload(r, challenge, uploadDirectory, part)
+		if err != nil {
+			log.Printf("Error saving upload %v for challenge %v: %v", name, challenge.ID, err)
+			uploadErrors = append(uploadErrors, uploadErrorMessage(name, err))
+
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				// the rest of the request body can't be read anymore
+				break
+			}
+			continue
+		}
+		uploaded = append(uploaded, name)
+	}
+
+	if current := challengeRepository.Get(challenge.ID); current != nil {
+		challenge = current
+	}
+	writeUploadPage(w, r, challenge, uploaded, uploadErrors)
+}